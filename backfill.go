@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+
+	"f0a.org/singlestore-near-analytics/src"
+	"github.com/pkg/errors"
+)
+
+var backfillFlags = flag.NewFlagSet("backfill", flag.ExitOnError)
+
+var backfillStartHeight = backfillFlags.String("start-height", "", "first block height to backfill")
+var backfillEndHeight = backfillFlags.String("end-height", "", "last block height to backfill (inclusive)")
+var backfillChunkSize = backfillFlags.Int64("chunk-size", 10000, "number of block heights per chunk; progress is recorded per chunk")
+var backfillWorkers = backfillFlags.Int("workers", 4, "number of chunks to replicate concurrently")
+var backfillBatchSize = backfillFlags.Int("batch-size", 100, "maximum number of blocks to replicate per batch")
+var backfillMaxBatchBytes = backfillFlags.Int64("max-batch-bytes", 512<<20, "upper bound on the size of a batch held in memory before it is loaded into singlestore; larger batches are split (0 disables)")
+
+func runBackfill(stopCtx context.Context, abortCtx context.Context, config *src.Config, pgConn *sql.DB, sdbConn *sql.DB) error {
+	if *backfillStartHeight == "" || *backfillEndHeight == "" {
+		return errors.New("--start-height and --end-height are required")
+	}
+
+	opts, err := config.ExtractOptions()
+	if err != nil {
+		return err
+	}
+	opts.Sink = config.Sink(sdbConn)
+	opts.MaxBytes = *backfillMaxBatchBytes
+
+	backfill := &src.Backfill{
+		StartHeight: src.ParseBigInt(*backfillStartHeight),
+		EndHeight:   src.ParseBigInt(*backfillEndHeight),
+		ChunkSize:   *backfillChunkSize,
+		Workers:     *backfillWorkers,
+		BatchSize:   *backfillBatchSize,
+		Retry:       retryPolicy,
+		Options:     opts,
+	}
+	return backfill.Run(stopCtx, abortCtx, pgConn, sdbConn)
+}
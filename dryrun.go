@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"log"
+	"math/big"
+	"time"
+
+	"f0a.org/singlestore-near-analytics/src"
+	"github.com/pkg/errors"
+)
+
+var dryRun = flag.Bool("dry-run", false, "read and encode batches from postgres starting at --start-height and report their size without touching singlestore")
+
+// replicateDryRun extracts batches like replicatePoll but only logs how many
+// rows and bytes each table would receive.
+func replicateDryRun(stopCtx context.Context, pgConn *sql.DB, opts src.ExtractOptions) error {
+	height := src.ParseBigInt(*startHeight)
+	if height.Sign() < 0 {
+		return errors.New("--dry-run requires --start-height since it does not read the checkpoint from singlestore")
+	}
+	if *batchSize < 1 {
+		return errors.New("--batch-size must be positive")
+	}
+	opts.DryRun = true
+
+	log.Printf("starting dry run at block height = %s", height)
+
+	totals := make(map[string]src.TableStats)
+	for stopCtx.Err() == nil {
+		batch, err := src.Extract(stopCtx, pgConn, nil, height, *batchSize, opts)
+		if errors.Is(err, src.ErrChainBroken) {
+			opts.Prev = nil
+			continue
+		}
+		if err != nil {
+			if stopCtx.Err() != nil {
+				break
+			}
+			return err
+		}
+		if batch == nil {
+			select {
+			case <-stopCtx.Done():
+			case <-time.After(*pollInterval):
+			}
+			continue
+		}
+
+		log.Printf("blocks %s to %s would load %d rows", height, batch.MaxBlockHeight, batch.Rows)
+		for _, stats := range batch.Stats() {
+			log.Printf("  %s: %d rows, %d bytes", stats.Table, stats.Rows, stats.Bytes)
+			total := totals[stats.Table]
+			total.Table = stats.Table
+			total.Rows += stats.Rows
+			total.Bytes += stats.Bytes
+			totals[stats.Table] = total
+		}
+
+		opts.Prev = batch
+		height = (&big.Int{}).Add(batch.MaxBlockHeight, big.NewInt(1))
+	}
+
+	log.Printf("dry run stopped before height %s; totals:", height)
+	for _, model := range src.Models {
+		if total, ok := totals[model.Table]; ok {
+			log.Printf("  %s: %d rows, %d bytes", total.Table, total.Rows, total.Bytes)
+		}
+	}
+	return nil
+}
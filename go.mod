@@ -3,18 +3,22 @@ module f0a.org/singlestore-near-analytics
 go 1.15
 
 require (
-	github.com/georgysavva/scany v0.2.8
 	github.com/go-sql-driver/mysql v1.6.0
-	github.com/hamba/avro v1.5.4
+	github.com/gofrs/uuid v3.2.0+incompatible // indirect
+	github.com/hamba/avro v1.8.0
 	github.com/iancoleman/strcase v0.1.3
-	github.com/jackc/pgtype v1.7.0
+	github.com/jackc/fake v0.0.0-20150926172116-812a484cc733 // indirect
+	github.com/jackc/pgconn v1.8.1
+	github.com/jackc/pglogrepl v0.0.0-20210731151948-9f1effd582c4
+	github.com/jackc/pgproto3/v2 v2.0.6
 	github.com/jackc/pgx v3.6.2+incompatible
-	github.com/jackc/pgx/v4 v4.11.0
 	github.com/lib/pq v1.10.1
-	github.com/paulbellamy/ratecounter v0.2.0
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.10.0
 	github.com/satori/go.uuid v1.2.0
+	github.com/shopspring/decimal v0.0.0-20200227202807-02e2044944cc // indirect
+	github.com/xitongsys/parquet-go v1.6.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
 	golang.org/x/text v0.3.3
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+
+	"f0a.org/singlestore-near-analytics/src"
+	"github.com/pkg/errors"
+)
+
+var initLoadFlags = flag.NewFlagSet("init-load", flag.ExitOnError)
+
+var initLoadChunkSize = initLoadFlags.Int64("chunk-size", 100000, "number of block heights per chunk of each table; progress is recorded per chunk")
+var initLoadWorkers = initLoadFlags.Int("workers", 4, "number of chunks to copy concurrently")
+var initLoadForce = initLoadFlags.Bool("force", false, "start a new load even though singlestore already contains replicated blocks")
+
+// runInitLoad copies every replicated table from postgres into singlestore,
+// replacing their contents, or resumes an interrupted copy. Once it finishes
+// the copied blocks are recorded in replication_meta so the replicator
+// carries on from there.
+func runInitLoad(stopCtx context.Context, abortCtx context.Context, config *src.Config, pgConn *sql.DB, sdbConn *sql.DB) error {
+	opts, err := config.ExtractOptions()
+	if err != nil {
+		return err
+	}
+	if opts.Accounts != nil {
+		return errors.New("the accounts filter is not supported by init-load")
+	}
+
+	load := &src.InitialLoad{
+		Tables:    opts.Tables,
+		ChunkSize: *initLoadChunkSize,
+		Workers:   *initLoadWorkers,
+		Replace:   *initLoadForce,
+	}
+	err = load.Run(stopCtx, abortCtx, config.Postgres, pgConn, sdbConn)
+	if errors.Is(err, src.ErrAlreadyLoaded) {
+		return errors.Wrap(err, "pass --force to replace every table")
+	}
+	return err
+}
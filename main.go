@@ -1,104 +1,401 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"flag"
+	"fmt"
 	"log"
 	"math/big"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"f0a.org/singlestore-near-analytics/src"
+	"github.com/pkg/errors"
 )
 
 var configPath = flag.String("config", "config.yaml", "path to the config file")
 var startHeight = flag.String("start-height", "-1", "start replicating at this block height")
-var batchSize = flag.Int("batch-size", 100, "maximum number of blocks to replicate per batch")
-var pollInterval = flag.Duration("poll-interval", time.Millisecond*500, "time to sleep between polling postgres for more blocks")
+var batchSize = flag.Int("batch-size", 100, "maximum number of blocks to replicate per batch; the starting point when --target-batch-duration or --target-batch-rows is set")
+var minBatchSize = flag.Int("min-batch-size", 1, "lower bound on the number of blocks per batch when adapting the batch size")
+var maxBatchSize = flag.Int("max-batch-size", 10000, "upper bound on the number of blocks per batch when adapting the batch size")
+var maxBatchBytes = flag.Int64("max-batch-bytes", 512<<20, "upper bound on the size of a batch held in memory before it is loaded into singlestore; larger batches are split (0 disables)")
+var targetBatchDuration = flag.Duration("target-batch-duration", 0, "adapt the batch size so each batch takes about this long to replicate (0 disables)")
+var targetBatchRows = flag.Int("target-batch-rows", 0, "adapt the batch size so each batch contains about this many rows (0 disables)")
+var pollInterval = flag.Duration("poll-interval", time.Millisecond*500, "time to sleep between polling postgres for more blocks; in cdc mode the maximum time to buffer changes before committing them")
+var pipelineDepth = flag.Int("pipeline-depth", 0, "number of batches to read from postgres ahead of the batch being loaded into singlestore (0 disables pipelining)")
+var gapCheckInterval = flag.Duration("gap-check-interval", 10*time.Minute, "how often to check replication_meta for gaps between replicated ranges (0 only checks, and with --heal-gaps heals, at startup)")
+var healGaps = flag.Bool("heal-gaps", false, "re-replicate any gaps found in replication_meta")
+var confirmationDepth = flag.Int64("confirmation-depth", 0, "stay this many blocks behind the postgres head so only final blocks are replicated (0 replicates up to the head)")
+var optimistic = flag.Bool("optimistic", false, "with --confirmation-depth, also replicate blocks which are not final yet and mark them as finalized once they are")
+var mutableLookback = flag.Int64("mutable-lookback", 0, "also re-read accounts and access_keys updated this many blocks before each batch, to catch updates the indexer writes late")
+var reconcileDeletes = flag.Bool("reconcile-deletes", false, "delete rows from accounts, access_keys and account_changes which were deleted from postgres")
+var source = flag.String("source", "poll", "how to find new rows in postgres: poll (query the blocks table) or cdc (consume a logical replication slot)")
+
+// retryPolicy controls how transient errors are retried by every command.
+var retryPolicy src.RetryPolicy
+
+func registerRetryFlags(flags *flag.FlagSet) {
+	flags.DurationVar(&retryPolicy.InitialBackoff, "retry-initial-backoff", time.Second, "how long to wait before the first retry after a transient error; doubles on every retry")
+	flags.DurationVar(&retryPolicy.MaxBackoff, "retry-max-backoff", time.Minute, "upper bound on the wait between retries")
+	flags.IntVar(&retryPolicy.MaxRetries, "max-retries", 10, "number of consecutive retries before giving up (-1 retries forever)")
+}
+
+func init() {
+	registerRetryFlags(flag.CommandLine)
+}
+
+// command is a subcommand of the replication tool. Every command gets the
+// config file, signal handling, the metrics server and connections to both
+// databases, except that offline commands are not connected to postgres and
+// get a nil pgConn, and commands whose skipSingleStore returns true once
+// their flags are parsed get a nil sdbConn.
+type command struct {
+	flags           *flag.FlagSet
+	configPath      *string
+	offline         bool
+	skipSingleStore func() bool
+	run             func(stopCtx context.Context, abortCtx context.Context, config *src.Config, pgConn *sql.DB, sdbConn *sql.DB) error
+}
+
+func newCommand(flags *flag.FlagSet, run func(stopCtx context.Context, abortCtx context.Context, config *src.Config, pgConn *sql.DB, sdbConn *sql.DB) error) *command {
+	registerRetryFlags(flags)
+	return &command{
+		flags:      flags,
+		configPath: flags.String("config", "config.yaml", "path to the config file"),
+		run:        run,
+	}
+}
+
+func newOfflineCommand(flags *flag.FlagSet, run func(stopCtx context.Context, abortCtx context.Context, config *src.Config, pgConn *sql.DB, sdbConn *sql.DB) error) *command {
+	cmd := newCommand(flags, run)
+	cmd.offline = true
+	return cmd
+}
+
+// connectsSingleStore reports whether the command needs a connection to
+// singlestore.
+func (c *command) connectsSingleStore() bool {
+	return c.skipSingleStore == nil || !c.skipSingleStore()
+}
+
+var commands = map[string]*command{
+	"backfill":  newCommand(backfillFlags, runBackfill),
+	"init-load": newCommand(initLoadFlags, runInitLoad),
+	"repair":    newCommand(repairFlags, runRepair),
+	"replay":    newOfflineCommand(replayFlags, runReplay),
+	"verify":    newCommand(verifyFlags, runVerify),
+}
 
 func main() {
-	flag.Parse()
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
-	if configPath == nil || *configPath == "" {
+	flag.Usage = func() {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n       %s <%s> [flags]\n\nFlags:\n",
+			os.Args[0], os.Args[0], strings.Join(names, "|"))
+		flag.PrintDefaults()
+	}
+
+	cmd := &command{
+		flags:      flag.CommandLine,
+		configPath: configPath,
+		run:        runReplicate,
+
+		// a dry run only reads from postgres
+		skipSingleStore: func() bool { return *dryRun },
+	}
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if sub, ok := commands[args[0]]; ok {
+			cmd = sub
+			args = args[1:]
+		}
+	}
+	cmd.flags.Parse(args)
+
+	if *cmd.configPath == "" {
 		log.Fatal("--config is required")
 	}
 
-	config, err := src.ParseConfig(*configPath)
+	config, err := src.ParseConfig(*cmd.configPath)
 	if err != nil {
-		log.Fatalf("unable to load config file: %s; error: %+v", *configPath, err)
+		log.Fatalf("unable to load config file: %s; error: %+v", *cmd.configPath, err)
 	}
 
-	go src.ServeMetrics(config.Metrics)
+	// The first signal stops polling once the current batch has been
+	// committed. A second signal aborts the current batch, rolling back any
+	// rows which have not been committed yet.
+	abortCtx, abort := context.WithCancel(context.Background())
+	defer abort()
+	stopCtx, stop := context.WithCancel(abortCtx)
+	defer stop()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("received %s; stopping after the current batch (send again to abort it)", sig)
+		stop()
+		sig = <-signals
+		log.Printf("received %s; aborting the current batch", sig)
+		abort()
+	}()
 
-	pgConn, err := src.ConnectPostgres(config.Postgres)
+	err = run(stopCtx, abortCtx, config, cmd)
 	if err != nil {
-		log.Fatalf("unable to connect to postgres: %+v", err)
+		log.Fatalf("%s failed: %+v", cmd.flags.Name(), err)
 	}
-	defer pgConn.Close()
+	log.Printf("%s stopped", cmd.flags.Name())
+}
 
-	sdbConn, err := src.ConnectSingleStore(config.SingleStore)
-	if err != nil {
-		log.Fatalf("unable to connect to singlestore: %+v", err)
+func run(stopCtx context.Context, abortCtx context.Context, config *src.Config, cmd *command) error {
+	metricsCtx, stopMetrics := context.WithCancel(context.Background())
+	metricsDone := make(chan struct{})
+	go func() {
+		defer close(metricsDone)
+		err := src.ServeMetrics(metricsCtx, config.Metrics)
+		if err != nil {
+			log.Fatalf("failed to start metrics server: %s", err)
+		}
+	}()
+	defer func() {
+		stopMetrics()
+		<-metricsDone
+	}()
+
+	var connected []string
+
+	var pgConn *sql.DB
+	if !cmd.offline {
+		var err error
+		pgConn, err = src.ConnectPostgres(config.Postgres)
+		if err != nil {
+			return errors.Wrap(err, "unable to connect to postgres")
+		}
+		defer pgConn.Close()
+		connected = append(connected, fmt.Sprintf("postgres (%s:%d)", config.Postgres.Host, config.Postgres.Port))
+	}
+
+	var sdbConn *sql.DB
+	if cmd.connectsSingleStore() {
+		var err error
+		sdbConn, err = src.ConnectSingleStore(config.SingleStore)
+		if err != nil {
+			return errors.Wrap(err, "unable to connect to singlestore")
+		}
+		defer sdbConn.Close()
+		connected = append(connected, fmt.Sprintf("singlestore (%s:%d)", config.SingleStore.Host, config.SingleStore.Port))
 	}
-	defer sdbConn.Close()
 
-	log.Printf("starting replication from postgres (%s:%d) to singlestore (%s:%d)",
-		config.Postgres.Host, config.Postgres.Port,
-		config.SingleStore.Host, config.SingleStore.Port)
+	log.Printf("connected to %s", strings.Join(connected, " and "))
 	log.Printf("metrics available at http://localhost:%d/metrics", config.Metrics.Port)
 
-	go src.MonitorBlockHeights(pgConn, sdbConn, time.Second)
+	return cmd.run(stopCtx, abortCtx, config, pgConn, sdbConn)
+}
+
+func runReplicate(stopCtx context.Context, abortCtx context.Context, config *src.Config, pgConn *sql.DB, sdbConn *sql.DB) error {
+	opts, err := config.ExtractOptions()
+	if err != nil {
+		return err
+	}
+	opts.MaxBytes = *maxBatchBytes
+
+	if *dryRun {
+		return replicateDryRun(stopCtx, pgConn, opts)
+	}
+	if *optimistic && *confirmationDepth <= 0 {
+		return errors.New("--optimistic requires a positive --confirmation-depth")
+	}
+	if *batchSize < 1 {
+		return errors.New("--batch-size must be positive")
+	}
+	opts.Sink = config.Sink(sdbConn)
+	opts.ConfirmationDepth = *confirmationDepth
+	opts.Optimistic = *optimistic
+	opts.MutableLookback = *mutableLookback
+	opts.ReconcileDeletes = *reconcileDeletes
+
+	go src.MonitorBlockHeights(stopCtx, pgConn, sdbConn, time.Second)
+
+	if *gapCheckInterval > 0 || *healGaps {
+		// gaps are healed alongside replication, which waits for the
+		// current heal to finish before the connections are closed
+		monitorCtx, stopMonitor := context.WithCancel(stopCtx)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		defer func() {
+			stopMonitor()
+			wg.Wait()
+		}()
+
+		// with --gap-check-interval 0 gaps are checked and healed once
+		go func() {
+			defer wg.Done()
+			src.MonitorReplicationGaps(monitorCtx, abortCtx, pgConn, sdbConn, *gapCheckInterval, *healGaps, *batchSize, retryPolicy, opts)
+		}()
+	} else {
+		_, err := src.CheckReplicationGaps(stopCtx, sdbConn)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch *source {
+	case "poll":
+		return replicatePoll(stopCtx, abortCtx, pgConn, sdbConn, opts)
+	case "cdc":
+		if opts.Accounts != nil {
+			return errors.New("the accounts filter is not supported with --source cdc")
+		}
+		return replicateCDC(stopCtx, abortCtx, config, sdbConn, opts.Tables)
+	default:
+		return errors.Errorf("unknown --source %q; must be poll or cdc", *source)
+	}
+}
+
+func replicateCDC(stopCtx context.Context, abortCtx context.Context, config *src.Config, sdbConn *sql.DB, tables *src.TableGraph) error {
+	// every attempt reconnects and resumes from the position last
+	// acknowledged to the replication slot
+	err := src.Retry(stopCtx, retryPolicy, "cdc", func() error {
+		cdc, err := src.NewCDCSource(stopCtx, config.Postgres, config.CDC, sdbConn, config.Sink(sdbConn), tables)
+		if err != nil {
+			return err
+		}
+		defer cdc.Close()
 
+		return cdc.Run(stopCtx, abortCtx, *batchSize, *pollInterval)
+	})
+	if err != nil && abortCtx.Err() != nil {
+		log.Printf("aborted the current batch")
+		return nil
+	}
+	if err != nil && stopCtx.Err() != nil && src.IsRetryable(err) {
+		log.Printf("stopped while waiting to retry: %v", err)
+		return nil
+	}
+	return err
+}
+
+func replicatePoll(stopCtx context.Context, abortCtx context.Context, pgConn *sql.DB, sdbConn *sql.DB, opts src.ExtractOptions) error {
 	height := src.ParseBigInt(*startHeight)
 
 	if height.Cmp(big.NewInt(-1)) == 0 {
 		var err error
 		height, err = src.ReadMaxReplicatedBlockHeight(sdbConn)
 		if err != nil {
-			log.Fatalf("unable to read highest block from singlestore: %+v", err)
+			return errors.Wrap(err, "unable to read highest block from singlestore")
 		}
 		if height.Cmp(big.NewInt(0)) == 0 {
-			log.Fatal("refusing to start from the first block; specify `--start-height 0` to override")
+			return errors.New("refusing to start from the first block; specify `--start-height 0` to override")
 		}
+		// rows left stale by a rewind which was interrupted before the
+		// blocks after it were replicated again are read again by the first
+		// batch
+		opts.Stale, err = src.ReadStaleKeys(stopCtx, sdbConn, opts.Tables, height)
+		if err != nil {
+			return errors.Wrap(err, "unable to read stale rows from singlestore")
+		}
+
 		// start replicating at the next block
 		height.Add(height, big.NewInt(1))
 	}
 
 	pgInitialMaxBlockHeight, err := src.ReadMaxBlockHeight(pgConn)
 	if err != nil {
-		log.Fatalf("unable to read highest block from postgres: %+v", err)
+		return errors.Wrap(err, "unable to read highest block from postgres")
 	}
 
 	log.Printf("starting replication at block height = %s", height)
 
-	limit := *batchSize
-	interval := *pollInterval
-	for {
-		start := time.Now()
+	sizer, err := src.NewBatchSizer(*batchSize, *minBatchSize, *maxBatchSize, *targetBatchDuration, *targetBatchRows)
+	if err != nil {
+		return err
+	}
+	for stopCtx.Err() == nil {
+		prevHeight := height
+		err = src.Retry(stopCtx, retryPolicy, "replicate", func() error {
+			var err error
+			if *pipelineDepth > 0 {
+				height, err = src.ReplicatePipelined(stopCtx, abortCtx, pgConn, sdbConn, height, sizer, *pipelineDepth, *pollInterval, opts)
+			} else {
+				height, err = replicateBatch(stopCtx, abortCtx, pgConn, sdbConn, height, sizer, opts, pgInitialMaxBlockHeight)
+			}
+			return err
+		})
 
-		replicatedHeight, err := src.Replicate(pgConn, sdbConn, height, limit)
+		if height.Cmp(prevHeight) != 0 {
+			// the stale rows were read again by the first batch
+			opts.Stale = nil
+		}
+
+		var reorg *src.ReorgError
+		if errors.As(err, &reorg) {
+			log.Printf("%s", reorg)
+			height = reorg.AncestorHeight.Add(reorg.AncestorHeight, big.NewInt(1))
+			opts.Stale = reorg.Stale
+			continue
+		}
+		if errors.Is(err, src.ErrChainBroken) {
+			log.Printf("chain changed while pipelining; restarting at height %s", height)
+			continue
+		}
 		if err != nil {
-			log.Fatalf("replication failed: %+v", err)
+			if abortCtx.Err() != nil {
+				log.Printf("aborted batch starting at height %s", height)
+				return nil
+			}
+			if stopCtx.Err() != nil && src.IsRetryable(err) {
+				log.Printf("stopped while waiting to retry: %v", err)
+				break
+			}
+			return err
 		}
+	}
 
-		replicationDuration := time.Now().Sub(start)
+	log.Printf("stopped replication; next batch starts at height %s", height)
+	return nil
+}
 
-		if replicatedHeight != nil {
-			// only record the replication time metric if we actually replicated something
-			src.MetricBatchReplicationTime.Observe(replicationDuration.Seconds())
+// replicateBatch replicates a single batch starting at height and returns
+// the height the next batch should start at.
+func replicateBatch(stopCtx context.Context, abortCtx context.Context, pgConn *sql.DB, sdbConn *sql.DB, height *big.Int, sizer *src.BatchSizer, opts src.ExtractOptions, pgInitialMaxBlockHeight *big.Int) (*big.Int, error) {
+	start := time.Now()
 
-			err = src.WriteReplicatedBlockHeight(sdbConn, replicatedHeight)
-			if err != nil {
-				log.Fatalf("replication failed: %+v", err)
-			}
+	batch, err := src.Replicate(abortCtx, pgConn, sdbConn, height, sizer.Limit(), opts)
+	if err != nil {
+		return height, err
+	}
 
-			height = replicatedHeight.Add(replicatedHeight, big.NewInt(1))
-		}
+	replicationDuration := time.Now().Sub(start)
+
+	if batch != nil {
+		// only record the replication time metric if we actually replicated something
+		src.MetricBatchReplicationTime.Observe(replicationDuration.Seconds())
+		sizer.Observe(batch.Blocks, batch.Rows, replicationDuration)
 
-		// only sleep if we have "caught up"
-		if height.Cmp(pgInitialMaxBlockHeight) >= 0 {
-			time.Sleep(interval - replicationDuration)
-		} else {
-			log.Printf("catching up to height %s, currently at height %s", pgInitialMaxBlockHeight, height)
+		height = (&big.Int{}).Add(batch.MaxBlockHeight, big.NewInt(1))
+	}
+
+	// only sleep if we have "caught up", which may be short of the postgres
+	// head when staying behind it by --confirmation-depth
+	if batch == nil || height.Cmp(pgInitialMaxBlockHeight) >= 0 {
+		select {
+		case <-stopCtx.Done():
+		case <-time.After(*pollInterval - replicationDuration):
 		}
+	} else {
+		log.Printf("catching up to height %s, currently at height %s", pgInitialMaxBlockHeight, height)
 	}
+
+	return height, nil
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"log"
+	"strings"
+
+	"f0a.org/singlestore-near-analytics/src"
+	"github.com/pkg/errors"
+)
+
+var repairFlags = flag.NewFlagSet("repair", flag.ExitOnError)
+
+var repairStartHeight = repairFlags.String("start-height", "", "first block height to repair")
+var repairEndHeight = repairFlags.String("end-height", "", "last block height to repair (inclusive)")
+var repairTables = repairFlags.String("tables", "", "comma separated list of tables to repair (default every replicated table)")
+var repairBatchSize = repairFlags.Int("batch-size", 100, "maximum number of blocks to replicate per batch")
+var repairMaxBatchBytes = repairFlags.Int64("max-batch-bytes", 512<<20, "upper bound on the size of a batch held in memory before it is loaded into singlestore; larger batches are split (0 disables)")
+
+// runRepair re-replicates a range of blocks without recording it in
+// replication_meta, so it can run alongside the replicator without moving its
+// checkpoint.
+func runRepair(stopCtx context.Context, abortCtx context.Context, config *src.Config, pgConn *sql.DB, sdbConn *sql.DB) error {
+	if *repairStartHeight == "" || *repairEndHeight == "" {
+		return errors.New("--start-height and --end-height are required")
+	}
+	start := src.ParseBigInt(*repairStartHeight)
+	end := src.ParseBigInt(*repairEndHeight)
+	if end.Cmp(start) < 0 {
+		return errors.Errorf("end height %s is below start height %s", end, start)
+	}
+
+	opts, err := config.ExtractOptions()
+	if err != nil {
+		return err
+	}
+	if *repairTables != "" {
+		opts.Tables, err = opts.Tables.Select(strings.Split(*repairTables, ","), nil)
+		if err != nil {
+			return errors.Wrap(err, "invalid --tables")
+		}
+	}
+	opts.SkipCheckpoint = true
+	opts.Sink = config.Sink(sdbConn)
+	opts.MaxBytes = *repairMaxBatchBytes
+
+	log.Printf("repairing blocks %s to %s", start, end)
+
+	// every committed batch is kept, so a retry resumes after the last one
+	next := start
+	var done bool
+	err = src.Retry(stopCtx, retryPolicy, "repair", func() error {
+		var err error
+		next, done, err = src.ReplicateRange(stopCtx, abortCtx, pgConn, sdbConn, next, end, *repairBatchSize, opts)
+		return err
+	})
+	if err != nil {
+		if abortCtx.Err() != nil {
+			log.Printf("aborted repair")
+			return nil
+		}
+		return err
+	}
+	if !done {
+		log.Printf("stopped before the repair finished; resume it with --start-height %s", next)
+		return nil
+	}
+
+	log.Printf("repaired blocks %s to %s", start, end)
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"log"
+
+	"f0a.org/singlestore-near-analytics/src"
+	"github.com/pkg/errors"
+)
+
+var replayFlags = flag.NewFlagSet("replay", flag.ExitOnError)
+
+var replayDir = replayFlags.String("dir", "", "directory of archived batches to replay (default archive.dir from the config file)")
+var replayStartHeight = replayFlags.String("start-height", "", "only replay batches starting at or after this block height")
+var replayEndHeight = replayFlags.String("end-height", "", "only replay batches ending at or before this block height")
+
+// runReplay loads archived batches into singlestore, recording their ranges
+// in replication_meta, without connecting to postgres.
+func runReplay(stopCtx context.Context, abortCtx context.Context, config *src.Config, pgConn *sql.DB, sdbConn *sql.DB) error {
+	replay := &src.Replay{Dir: *replayDir}
+	if replay.Dir == "" {
+		replay.Dir = config.Archive.Dir
+	}
+	if replay.Dir == "" {
+		return errors.New("--dir is required when the config file has no archive")
+	}
+	if *replayStartHeight != "" {
+		replay.StartHeight = src.ParseBigInt(*replayStartHeight)
+	}
+	if *replayEndHeight != "" {
+		replay.EndHeight = src.ParseBigInt(*replayEndHeight)
+	}
+
+	err := replay.Run(stopCtx, abortCtx, src.NewSingleStoreSink(sdbConn))
+	if err != nil {
+		if abortCtx.Err() != nil {
+			log.Printf("aborted replay")
+			return nil
+		}
+		return err
+	}
+	return nil
+}
@@ -3,15 +3,40 @@ create database near;
 use near;
 
 -- the replication_meta table contains one row per range of blocks replicated to
--- this database.  The block_height field refers to the highest block_height in
--- the range of replicated blocks.
+-- this database.  The start_height and block_height fields refer to the lowest
+-- and highest block_height in the range of replicated blocks.
+--
+-- to upgrade an existing database run:
+--   ALTER TABLE replication_meta ADD COLUMN start_height DECIMAL(20,0);
+-- rows without a start_height are assumed to cover every block below them.
 CREATE TABLE replication_meta (
+    start_height DECIMAL(20,0),
     block_height DECIMAL(20,0) NOT NULL,
     KEY (block_height) USING CLUSTERED COLUMNSTORE,
     UNIQUE KEY (block_height) USING HASH,
     SHARD (block_height)
 );
 
+-- the backfill_progress table contains one row per chunk of blocks completed
+-- by the backfill command, so an interrupted backfill can be resumed.
+CREATE TABLE backfill_progress (
+    start_height DECIMAL(20,0) NOT NULL,
+    end_height DECIMAL(20,0) NOT NULL,
+    completed_at DATETIME NOT NULL,
+    PRIMARY KEY (start_height, end_height)
+);
+
+-- the init_load_progress table contains one row per chunk of a table copied
+-- by the init-load command, so an interrupted initial load can be resumed. It
+-- is emptied once the initial load finishes.
+CREATE TABLE init_load_progress (
+    table_name VARCHAR(255) NOT NULL,
+    start_height DECIMAL(20,0) NOT NULL,
+    end_height DECIMAL(20,0) NOT NULL,
+    completed_at DATETIME NOT NULL,
+    PRIMARY KEY (table_name, start_height, end_height)
+);
+
 CREATE TABLE access_keys (
     public_key TEXT NOT NULL,
     account_id TEXT NOT NULL,
@@ -112,6 +137,13 @@ CREATE TABLE action_receipts (
 CREATE INDEX action_receipt_signer_account_id_idx ON action_receipts  (signer_account_id);
 
 -- BIG TABLE
+--
+-- finalized is false for blocks replicated with --optimistic before they were
+-- --confirmation-depth blocks below the postgres head.  To only see settled
+-- data filter on finalized, joining other tables to blocks by block hash.
+--
+-- to upgrade an existing database run:
+--   ALTER TABLE blocks ADD COLUMN finalized BOOL NOT NULL DEFAULT TRUE;
 CREATE TABLE blocks (
     block_height DECIMAL(20,0) NOT NULL,
     block_hash TEXT NOT NULL,
@@ -120,6 +152,7 @@ CREATE TABLE blocks (
     total_supply DECIMAL(45,0) NOT NULL,
     gas_price DECIMAL(45,0) NOT NULL,
     author_account_id TEXT NOT NULL,
+    finalized BOOL NOT NULL DEFAULT TRUE,
     KEY (block_hash) USING CLUSTERED COLUMNSTORE,
     UNIQUE KEY (block_hash) USING HASH,
     SHARD (block_hash)
@@ -133,7 +166,7 @@ CREATE INDEX blocks_timestamp_idx ON blocks  (block_timestamp) using hash;
 CREATE TABLE chunks (
     included_in_block_hash TEXT NOT NULL,
     chunk_hash TEXT NOT NULL,
-    shard_id DECIMAL(20,0) NOT NULL,
+    shard_id BIGINT NOT NULL,
     signature TEXT NOT NULL,
     gas_limit DECIMAL(20,0) NOT NULL,
     gas_used DECIMAL(20,0) NOT NULL,
@@ -171,7 +204,7 @@ CREATE TABLE execution_outcomes (
     tokens_burnt DECIMAL(45,0) NOT NULL,
     executor_account_id TEXT NOT NULL,
     status TEXT NOT NULL,
-    shard_id DECIMAL(20,0) NOT NULL,
+    shard_id BIGINT NOT NULL,
     PRIMARY KEY (receipt_id)
 );
 
@@ -0,0 +1,69 @@
+package src
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// accountScoped is implemented by models which belong to the activity of
+// particular accounts. Rows of other models are either replicated in full or
+// follow their parent table.
+type accountScoped interface {
+	Accounts() []string
+}
+
+// AccountFilter matches account IDs against a list of exact IDs and suffix
+// patterns such as "*.near".
+type AccountFilter struct {
+	exact    map[string]bool
+	suffixes []string
+}
+
+// NewAccountFilter parses patterns into a filter. A pattern is either an
+// exact account ID or "*" followed by a suffix.
+func NewAccountFilter(patterns []string) (*AccountFilter, error) {
+	f := &AccountFilter{exact: make(map[string]bool)}
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "*") {
+			suffix := pattern[1:]
+			if suffix == "" || strings.Contains(suffix, "*") {
+				return nil, errors.Errorf("invalid account pattern %q; wildcards are only supported at the start, e.g. *.near", pattern)
+			}
+			f.suffixes = append(f.suffixes, suffix)
+		} else if strings.Contains(pattern, "*") || pattern == "" {
+			return nil, errors.Errorf("invalid account pattern %q; wildcards are only supported at the start, e.g. *.near", pattern)
+		} else {
+			f.exact[pattern] = true
+		}
+	}
+	return f, nil
+}
+
+// Match reports whether accountID matches any of the patterns.
+func (f *AccountFilter) Match(accountID string) bool {
+	if f.exact[accountID] {
+		return true
+	}
+	for _, suffix := range f.suffixes {
+		if strings.HasSuffix(accountID, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Includes reports whether row should be replicated. Rows which do not
+// belong to any account are always included.
+func (f *AccountFilter) Includes(row Model) bool {
+	scoped, ok := row.(accountScoped)
+	if !ok {
+		return true
+	}
+	for _, account := range scoped.Accounts() {
+		if f.Match(account) {
+			return true
+		}
+	}
+	return false
+}
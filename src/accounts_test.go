@@ -0,0 +1,70 @@
+package src
+
+import "testing"
+
+func TestNewAccountFilter(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		ok       bool
+	}{
+		{[]string{"alice.near", "*.near"}, true},
+		{[]string{"*"}, false},
+		{[]string{""}, false},
+		{[]string{"a*.near"}, false},
+		{[]string{"*.*.near"}, false},
+	}
+	for _, tt := range tests {
+		_, err := NewAccountFilter(tt.patterns)
+		if (err == nil) != tt.ok {
+			t.Errorf("NewAccountFilter(%q): got error %v, want ok %v", tt.patterns, err, tt.ok)
+		}
+	}
+}
+
+func TestAccountFilterMatch(t *testing.T) {
+	f, err := NewAccountFilter([]string{"alice.near", "*.pool.near"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		account string
+		want    bool
+	}{
+		{"alice.near", true},
+		{"bob.near", false},
+		{"sub.alice.near", false},
+		{"staking.pool.near", true},
+		{"a.b.pool.near", true},
+		{"pool.near", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := f.Match(tt.account); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.account, got, tt.want)
+		}
+	}
+}
+
+func TestAccountFilterIncludes(t *testing.T) {
+	f, err := NewAccountFilter([]string{"*.pool.near"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		row  Model
+		want bool
+	}{
+		{"not account scoped", &Block{}, true},
+		{"receipt from match", &Receipt{PredecessorAccountId: "a.pool.near", ReceiverAccountId: "bob.near"}, true},
+		{"receipt to match", &Receipt{PredecessorAccountId: "bob.near", ReceiverAccountId: "a.pool.near"}, true},
+		{"receipt without match", &Receipt{PredecessorAccountId: "bob.near", ReceiverAccountId: "carol.near"}, false},
+		{"transaction signer", &Transaction{SignerAccountId: "a.pool.near"}, true},
+		{"outcome executor", &ExecutionOutcome{ExecutorAccountId: "carol.near"}, false},
+	}
+	for _, tt := range tests {
+		if got := f.Includes(tt.row); got != tt.want {
+			t.Errorf("%s: Includes = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,601 @@
+package src
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hamba/avro"
+	"github.com/hamba/avro/ocf"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// archiveManifest is the name of the file describing an archived batch
+const archiveManifest = "batch.json"
+
+// ArchiveSink keeps a copy of every batch as Avro Object Container Files, one
+// per table, with the schema of the table embedded. Each batch is stored in
+// its own directory:
+//
+//	<dir>/<start height>-<end height>/batch.json
+//	<dir>/<start height>-<end height>/<table>.avro
+//
+// Rows deleted before or after the rows of the batch were written are stored
+// in <table>.deleted-before.avro and <table>.deleted-after.avro with only
+// their key fields set. Batches committed without a range, such as repairs,
+// are named by a random ID instead. Tables without any rows have no file.
+//
+// Rewinds of SingleStore after a chain reorganization are archived as
+// directories with only a batch.json, named rewind-<height>-<random ID>.
+//
+// The directory of a batch is written under a temporary name and renamed when
+// the batch is committed, so every directory with a batch.json is complete.
+// Archived batches are loaded again with Replay.
+type ArchiveSink struct {
+	Dir string
+}
+
+func NewArchiveSink(dir string) *ArchiveSink {
+	return &ArchiveSink{Dir: dir}
+}
+
+// RecordRewind archives a rewind of SingleStore to height, so that Replay
+// rewinds it again between the same batches.
+func (s *ArchiveSink) RecordRewind(height *big.Int) error {
+	id := uuid.NewV4().String()
+	tmp := filepath.Join(s.Dir, "."+id+".tmp")
+	err := os.MkdirAll(tmp, 0755)
+	if err != nil {
+		return errors.Wrap(err, "failed to create archive directory")
+	}
+
+	manifest := ArchivedBatch{
+		RewindHeight: height,
+		CommittedAt:  time.Now().UTC(),
+		Tables:       make(map[string]int64),
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(tmp, archiveManifest), data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(s.Dir, fmt.Sprintf("rewind-%020d-%s", height, id)))
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return errors.Wrap(err, "failed to archive rewind")
+	}
+	return nil
+}
+
+// Begin creates the temporary directory of the batch.
+func (s *ArchiveSink) Begin(tables *TableGraph) (SinkBatch, error) {
+	id := uuid.NewV4().String()
+	b := &archiveBatch{
+		dir:    s.Dir,
+		id:     id,
+		tmp:    filepath.Join(s.Dir, "."+id+".tmp"),
+		tables: make(map[string]*archiveTable),
+	}
+
+	err := os.MkdirAll(b.tmp, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create archive directory")
+	}
+
+	for _, model := range Models {
+		if !tables.Loads(model.Table) {
+			continue
+		}
+		t := &archiveTable{model: model}
+		if _, ok := deleteKeys[model.Table]; ok {
+			t.written = make(map[string]bool)
+			t.deleteBefore = make(map[string]Model)
+			t.deleteAfter = make(map[string]Model)
+		}
+		b.tables[model.Table] = t
+	}
+	return b, nil
+}
+
+type archiveBatch struct {
+	dir             string
+	id              string
+	tmp             string
+	tables          map[string]*archiveTable
+	finalizedHeight *big.Int
+}
+
+type archiveTable struct {
+	model ModelInfo
+	rows  *archiveFile
+
+	// deletes are tracked like Stream does, so that replaying them around
+	// the rows of the batch gives the same result
+	written      map[string]bool
+	deleteBefore map[string]Model
+	deleteAfter  map[string]Model
+}
+
+// archiveFile is an Object Container File which is created on the first row
+// written to it.
+type archiveFile struct {
+	file *os.File
+	buf  *bufio.Writer
+	enc  *ocf.Encoder
+	rows int64
+}
+
+func createArchiveFile(path string, model ModelInfo) (*archiveFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(file)
+	enc, err := ocf.NewEncoder(model.Schema.String(), buf, ocf.WithCodec(ocf.Deflate))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &archiveFile{file: file, buf: buf, enc: enc}, nil
+}
+
+func (f *archiveFile) close() error {
+	if f == nil || f.file == nil {
+		return nil
+	}
+	err := f.enc.Close()
+	if err == nil {
+		err = f.buf.Flush()
+	}
+	closeErr := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (b *archiveBatch) table(name string) (*archiveTable, error) {
+	t, ok := b.tables[name]
+	if !ok {
+		return nil, errors.Errorf("no table with name %s", name)
+	}
+	return t, nil
+}
+
+func (b *archiveBatch) WriteRow(table string, row Model) error {
+	t, err := b.table(table)
+	if err != nil {
+		return err
+	}
+
+	if t.rows == nil {
+		t.rows, err = createArchiveFile(filepath.Join(b.tmp, table+".avro"), t.model)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create archive file for %s", table)
+		}
+	}
+	err = t.rows.enc.Encode(row)
+	if err != nil {
+		return errors.Wrapf(err, "failed to archive %s", table)
+	}
+	t.rows.rows++
+
+	if t.written != nil {
+		key := row.Key()
+		t.written[key] = true
+		delete(t.deleteAfter, key)
+	}
+	return nil
+}
+
+func (b *archiveBatch) Delete(table string, row Model) error {
+	t, err := b.table(table)
+	if err != nil {
+		return err
+	}
+	if t.written == nil {
+		return errors.Errorf("rows cannot be deleted from %s", table)
+	}
+
+	key := row.Key()
+	if t.written[key] {
+		t.deleteAfter[key] = row
+	} else {
+		t.deleteBefore[key] = row
+	}
+	return nil
+}
+
+// Finalize records height in batch.json.
+func (b *archiveBatch) Finalize(height *big.Int) error {
+	b.finalizedHeight = height
+	return nil
+}
+
+// ArchivedBatch is the contents of batch.json.
+type ArchivedBatch struct {
+	StartHeight     *big.Int  `json:"start_height"`
+	EndHeight       *big.Int  `json:"end_height"`
+	FinalizedHeight *big.Int  `json:"finalized_height,omitempty"`
+	CommittedAt     time.Time `json:"committed_at"`
+
+	// RewindHeight is set if SingleStore was rewound to this height after a
+	// chain reorganization instead of a batch being committed
+	RewindHeight *big.Int `json:"rewind_height,omitempty"`
+
+	// Tables has the number of rows archived for every table in the batch
+	Tables map[string]int64 `json:"tables"`
+
+	// DeletedBefore and DeletedAfter have the number of rows deleted before
+	// and after the rows of each table were written
+	DeletedBefore map[string]int64 `json:"deleted_before,omitempty"`
+	DeletedAfter  map[string]int64 `json:"deleted_after,omitempty"`
+}
+
+func writeDeletes(path string, model ModelInfo, rows map[string]Model) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(rows))
+	for key := range rows {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	f, err := createArchiveFile(path, model)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = f.enc.Encode(rows[key])
+		if err != nil {
+			f.close()
+			return err
+		}
+	}
+	return f.close()
+}
+
+// Commit finishes every file, writes batch.json and moves the directory to
+// its final name, replacing the directory of an earlier attempt at the same
+// range. The earlier directory is moved aside until the new one is in place,
+// so it is kept if Commit fails. Directories of other batches committed from
+// the same start height are removed once the new one is in place. If Commit
+// fails the temporary directory is removed.
+func (b *archiveBatch) Commit(ctx context.Context, startHeight *big.Int, endHeight *big.Int) (err error) {
+	defer func() {
+		if err != nil {
+			b.Abort()
+		}
+	}()
+
+	manifest := ArchivedBatch{
+		StartHeight:     startHeight,
+		EndHeight:       endHeight,
+		FinalizedHeight: b.finalizedHeight,
+		Tables:          make(map[string]int64),
+		DeletedBefore:   make(map[string]int64),
+		DeletedAfter:    make(map[string]int64),
+	}
+
+	for table, t := range b.tables {
+		err = t.rows.close()
+		if err != nil {
+			return errors.Wrapf(err, "failed to finish archive file for %s", table)
+		}
+		if t.rows != nil {
+			manifest.Tables[table] = t.rows.rows
+		} else {
+			manifest.Tables[table] = 0
+		}
+
+		err = writeDeletes(filepath.Join(b.tmp, table+".deleted-before.avro"), t.model, t.deleteBefore)
+		if err != nil {
+			return errors.Wrapf(err, "failed to archive deletes from %s", table)
+		}
+		err = writeDeletes(filepath.Join(b.tmp, table+".deleted-after.avro"), t.model, t.deleteAfter)
+		if err != nil {
+			return errors.Wrapf(err, "failed to archive deletes from %s", table)
+		}
+		if n := len(t.deleteBefore); n > 0 {
+			manifest.DeletedBefore[table] = int64(n)
+		}
+		if n := len(t.deleteAfter); n > 0 {
+			manifest.DeletedAfter[table] = int64(n)
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	manifest.CommittedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(b.tmp, archiveManifest), data, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to write batch.json")
+	}
+
+	name := b.id
+	if startHeight != nil && endHeight != nil {
+		name = fmt.Sprintf("%020d-%020d", startHeight, endHeight)
+	}
+	dst := filepath.Join(b.dir, name)
+	old := filepath.Join(b.dir, "."+b.id+".old")
+	err = os.Rename(dst, old)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to replace archived batch")
+	}
+	replaced := err == nil
+
+	err = os.Rename(b.tmp, dst)
+	if err != nil {
+		if replaced {
+			os.Rename(old, dst)
+		}
+		return errors.Wrap(err, "failed to move archived batch")
+	}
+	if replaced {
+		if err := os.RemoveAll(old); err != nil {
+			log.Printf("failed to remove replaced archive directory %s: %+v", old, err)
+		}
+	}
+
+	if startHeight != nil && endHeight != nil {
+		err = b.removeReplaced(startHeight, name)
+		if err != nil {
+			return errors.Wrap(err, "failed to remove replaced batches")
+		}
+	}
+	return nil
+}
+
+// removeReplaced removes the directories other than the one named name of
+// batches committed from startHeight, like parquetBatch.removeReplaced.
+// batch.json is removed before the files, so that a directory with a
+// batch.json is always complete.
+func (b *archiveBatch) removeReplaced(startHeight *big.Int, name string) error {
+	paths, err := filepath.Glob(filepath.Join(b.dir, fmt.Sprintf("%020d-*", startHeight)))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if filepath.Base(path) == name {
+			continue
+		}
+		err = os.Remove(filepath.Join(path, archiveManifest))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Abort removes the temporary directory of the batch.
+func (b *archiveBatch) Abort() error {
+	for _, t := range b.tables {
+		if t.rows != nil && t.rows.file != nil {
+			t.rows.file.Close()
+			t.rows.file = nil
+		}
+	}
+	return os.RemoveAll(b.tmp)
+}
+
+// Replay loads batches archived by ArchiveSink into a sink without reading
+// Postgres. Batches and rewinds are replayed in the order they were
+// committed.
+type Replay struct {
+	Dir string
+
+	// StartHeight and EndHeight limit the replay to the batches within the
+	// range, and the rewinds which delete blocks within it. Either may be nil
+	// for no limit. Batches archived without a range are only replayed when
+	// neither is set.
+	StartHeight *big.Int
+	EndHeight   *big.Int
+}
+
+type archivedBatchDir struct {
+	dir   string
+	batch ArchivedBatch
+}
+
+func (r *Replay) readBatches() ([]archivedBatchDir, error) {
+	paths, err := filepath.Glob(filepath.Join(r.Dir, "*", archiveManifest))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]archivedBatchDir, 0, len(paths))
+	for _, path := range paths {
+		// skip the temporary directories of uncommitted batches
+		if strings.HasPrefix(filepath.Base(filepath.Dir(path)), ".") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read archived batch")
+		}
+		var batch ArchivedBatch
+		err = json.Unmarshal(data, &batch)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", path)
+		}
+
+		if batch.RewindHeight != nil {
+			// the rewind deletes the blocks above its height
+			next := (&big.Int{}).Add(batch.RewindHeight, big.NewInt(1))
+			if r.StartHeight != nil && next.Cmp(r.StartHeight) < 0 {
+				continue
+			}
+			if r.EndHeight != nil && next.Cmp(r.EndHeight) > 0 {
+				continue
+			}
+		} else if r.StartHeight != nil || r.EndHeight != nil {
+			if batch.StartHeight == nil || batch.EndHeight == nil {
+				continue
+			}
+			if r.StartHeight != nil && batch.StartHeight.Cmp(r.StartHeight) < 0 {
+				continue
+			}
+			if r.EndHeight != nil && batch.EndHeight.Cmp(r.EndHeight) > 0 {
+				continue
+			}
+		}
+		out = append(out, archivedBatchDir{dir: filepath.Dir(path), batch: batch})
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].batch.CommittedAt.Before(out[j].batch.CommittedAt)
+	})
+	return out, nil
+}
+
+// errArchiveSchema is returned when replaying a file archived with a schema
+// other than the current schema of its table, such as the archives written
+// before decimal columns were archived as Avro decimals or shard ids as longs.
+var errArchiveSchema = errors.New("archived with a different schema than the table has now; replay it with the version which archived it")
+
+// readArchiveFile passes every row in an Object Container File to fn. A
+// missing file has no rows.
+func readArchiveFile(path string, model ModelInfo, fn func(Model) error) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec, err := ocf.NewDecoder(bufio.NewReader(f))
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", path)
+	}
+	schema, err := avro.Parse(string(dec.Metadata()["avro.schema"]))
+	if err != nil {
+		return errors.Wrapf(err, "failed to read the schema of %s", path)
+	}
+	if schema.String() != model.Schema.String() {
+		return errors.Wrap(errArchiveSchema, path)
+	}
+	for dec.HasNext() {
+		row := model.New()
+		err = dec.Decode(row)
+		if err != nil {
+			return errors.Wrapf(err, "failed to decode %s", path)
+		}
+		err = fn(row)
+		if err != nil {
+			return err
+		}
+	}
+	return dec.Error()
+}
+
+// Run replays every batch into sink, committing each one along with its range.
+// It stops before the next batch once stopCtx is cancelled; cancelling
+// abortCtx rolls back the batch being committed.
+func (r *Replay) Run(stopCtx context.Context, abortCtx context.Context, sink Sink) error {
+	batches, err := r.readBatches()
+	if err != nil {
+		return err
+	}
+	log.Printf("replaying %d archived batches from %s", len(batches), r.Dir)
+
+	models := make(map[string]ModelInfo)
+	for _, model := range Models {
+		models[model.Table] = model
+	}
+
+	for _, archived := range batches {
+		if stopCtx.Err() != nil {
+			log.Printf("stopped before the replay finished")
+			return nil
+		}
+
+		if archived.batch.RewindHeight != nil {
+			rewinder, ok := sink.(rewinder)
+			if !ok {
+				return errors.Errorf("failed to replay %s: rewinds can not be replayed into this sink", archived.dir)
+			}
+			err = rewinder.Rewind(abortCtx, archived.batch.RewindHeight)
+			if err != nil {
+				return errors.Wrapf(err, "failed to replay %s", archived.dir)
+			}
+			log.Printf("replayed rewind to height %s from %s", archived.batch.RewindHeight, archived.dir)
+			continue
+		}
+
+		err = r.replayBatch(abortCtx, sink, models, archived)
+		if err != nil {
+			return errors.Wrapf(err, "failed to replay %s", archived.dir)
+		}
+		log.Printf("replayed blocks %s to %s from %s", archived.batch.StartHeight, archived.batch.EndHeight, archived.dir)
+	}
+	return nil
+}
+
+func (r *Replay) replayBatch(ctx context.Context, sink Sink, models map[string]ModelInfo, archived archivedBatchDir) error {
+	batch, err := sink.Begin(DefaultTableGraph)
+	if err != nil {
+		return err
+	}
+
+	tables := make([]string, 0, len(archived.batch.Tables))
+	for table := range archived.batch.Tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	for _, table := range tables {
+		model, ok := models[table]
+		if !ok {
+			batch.Abort()
+			return errors.Errorf("unknown table %s", table)
+		}
+		base := filepath.Join(archived.dir, table)
+
+		err = readArchiveFile(base+".deleted-before.avro", model, func(row Model) error { return batch.Delete(table, row) })
+		if err == nil {
+			err = readArchiveFile(base+".avro", model, func(row Model) error { return batch.WriteRow(table, row) })
+		}
+		if err == nil {
+			err = readArchiveFile(base+".deleted-after.avro", model, func(row Model) error { return batch.Delete(table, row) })
+		}
+		if err != nil {
+			batch.Abort()
+			return err
+		}
+	}
+
+	if archived.batch.FinalizedHeight != nil {
+		err = batch.Finalize(archived.batch.FinalizedHeight)
+		if err != nil {
+			batch.Abort()
+			return err
+		}
+	}
+
+	return batch.Commit(ctx, archived.batch.StartHeight, archived.batch.EndHeight)
+}
@@ -0,0 +1,219 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hamba/avro/ocf"
+	"github.com/pkg/errors"
+)
+
+// recordingSink records the batches and rewinds replayed into it.
+type recordingSink struct {
+	events []string
+}
+
+func (s *recordingSink) Begin(tables *TableGraph) (SinkBatch, error) {
+	return &recordingBatch{sink: s}, nil
+}
+
+func (s *recordingSink) Rewind(ctx context.Context, height *big.Int) error {
+	s.events = append(s.events, fmt.Sprintf("rewind %s", height))
+	return nil
+}
+
+type recordingBatch struct {
+	sink *recordingSink
+	rows []string
+}
+
+func (b *recordingBatch) WriteRow(table string, row Model) error {
+	b.rows = append(b.rows, table+":"+row.Key())
+	return nil
+}
+
+func (b *recordingBatch) Delete(table string, row Model) error {
+	b.rows = append(b.rows, "delete "+table+":"+row.Key())
+	return nil
+}
+
+func (b *recordingBatch) Finalize(height *big.Int) error {
+	return nil
+}
+
+func (b *recordingBatch) Commit(ctx context.Context, startHeight *big.Int, endHeight *big.Int) error {
+	b.sink.events = append(b.sink.events, fmt.Sprintf("commit %s-%s %v", startHeight, endHeight, b.rows))
+	return nil
+}
+
+func (b *recordingBatch) Abort() error {
+	return nil
+}
+
+func archiveTestBatch(t *testing.T, sink *ArchiveSink, start, end int64, hashes ...string) {
+	t.Helper()
+	batch, err := sink.Begin(DefaultTableGraph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range hashes {
+		err = batch.WriteRow("chunks", &Chunk{ChunkHash: hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = batch.Commit(context.Background(), big.NewInt(start), big.NewInt(end))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := NewArchiveSink(dir)
+	archiveTestBatch(t, archive, 5, 9, "a")
+	// archiving the same range again replaces it, as does a batch from the
+	// same start height covering other blocks
+	archiveTestBatch(t, archive, 5, 9, "b")
+	archiveTestBatch(t, archive, 5, 11, "e")
+	archiveTestBatch(t, archive, 5, 9, "b")
+	err = archive.RecordRewind(big.NewInt(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archiveTestBatch(t, archive, 8, 9, "c")
+	archiveTestBatch(t, archive, 10, 12, "d")
+
+	// an uncommitted batch is not replayed
+	uncommitted, err := archive.Begin(DefaultTableGraph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uncommitted.Abort()
+	err = ioutil.WriteFile(filepath.Join(uncommitted.(*archiveBatch).tmp, archiveManifest), []byte(`{"tables": {}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		start, end *big.Int
+		want       []string
+	}{
+		{
+			name: "everything",
+			want: []string{"commit 5-9 [chunks:b]", "rewind 7", "commit 8-9 [chunks:c]", "commit 10-12 [chunks:d]"},
+		},
+		{
+			name:  "rewind within the range",
+			start: big.NewInt(8),
+			end:   big.NewInt(9),
+			want:  []string{"rewind 7", "commit 8-9 [chunks:c]"},
+		},
+		{
+			name:  "rewind below the range",
+			start: big.NewInt(10),
+			want:  []string{"commit 10-12 [chunks:d]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			replay := &Replay{Dir: dir, StartHeight: tt.start, EndHeight: tt.end}
+			err := replay.Run(context.Background(), context.Background(), sink)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(sink.events, tt.want) {
+				t.Errorf("replayed %v, want %v", sink.events, tt.want)
+			}
+		})
+	}
+
+	// only the committed directories and the uncommitted batch are left
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 5 {
+		names := make([]string, 0, len(entries))
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("archive contains %v", names)
+	}
+}
+
+func TestReplayRewindRequiresRewinder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = NewArchiveSink(dir).RecordRewind(big.NewInt(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&Replay{Dir: dir}).Run(context.Background(), context.Background(), NewParquetSink(dir))
+	if err == nil {
+		t.Error("expected an error replaying a rewind into a sink which can not rewind")
+	}
+}
+
+func TestReplayRefusesOldSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archiveTestBatch(t, NewArchiveSink(dir), 5, 9, "a")
+
+	// archives written before decimals were typed have every decimal as a
+	// string
+	type stringChunk struct {
+		IncludedInBlockHash string
+		ChunkHash           string
+		ShardId             string
+		Signature           string
+		GasLimit            string
+		GasUsed             string
+		AuthorAccountId     string
+	}
+	schema, _, err := generateSchema(reflect.TypeOf(stringChunk{}), "Chunk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(filepath.Join(dir, "00000000000000000005-00000000000000000009", "chunks.avro"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := ocf.NewEncoder(schema.String(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = enc.Encode(&stringChunk{ChunkHash: "a"})
+	if err == nil {
+		err = enc.Close()
+	}
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = (&Replay{Dir: dir}).Run(context.Background(), context.Background(), &recordingSink{})
+	if !errors.Is(err, errArchiveSchema) {
+		t.Errorf("got error %v, want %v", err, errArchiveSchema)
+	}
+}
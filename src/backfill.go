@@ -0,0 +1,165 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math/big"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Backfill re-replicates a bounded range of blocks by splitting it into
+// chunks and replicating several chunks concurrently. Finished chunks are
+// recorded in backfill_progress so that running the same backfill again
+// skips them.
+type Backfill struct {
+	StartHeight *big.Int
+	EndHeight   *big.Int
+	ChunkSize   int64
+	Workers     int
+	BatchSize   int
+	Retry       RetryPolicy
+
+	// Options are passed to Extract for every batch
+	Options ExtractOptions
+}
+
+// heightRange is an inclusive range of block heights
+type heightRange struct {
+	start *big.Int
+	end   *big.Int
+}
+
+// splitHeights splits the heights between start and end (inclusive) into
+// ranges of up to size heights.
+func splitHeights(start *big.Int, end *big.Int, size int64) []heightRange {
+	out := make([]heightRange, 0)
+	step := big.NewInt(size)
+	for from := (&big.Int{}).Set(start); from.Cmp(end) <= 0; from = (&big.Int{}).Add(from, step) {
+		to := (&big.Int{}).Add(from, step)
+		to.Sub(to, big.NewInt(1))
+		if to.Cmp(end) > 0 {
+			to.Set(end)
+		}
+		out = append(out, heightRange{start: from, end: to})
+	}
+	return out
+}
+
+func readCompletedChunks(ctx context.Context, sdbConn *sql.DB, startHeight, endHeight *big.Int) (map[string]bool, error) {
+	rows, err := sdbConn.QueryContext(ctx, "SELECT start_height, end_height FROM backfill_progress WHERE start_height >= ? AND end_height <= ?", startHeight.String(), endHeight.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read backfill progress")
+	}
+	defer rows.Close()
+
+	out := make(map[string]bool)
+	for rows.Next() {
+		var start, end string
+		err = rows.Scan(&start, &end)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan backfill progress")
+		}
+		out[start+":"+end] = true
+	}
+	return out, rows.Err()
+}
+
+func writeCompletedChunk(ctx context.Context, sdbConn *sql.DB, chunk heightRange) error {
+	_, err := sdbConn.ExecContext(ctx, "REPLACE INTO backfill_progress (start_height, end_height, completed_at) VALUES (?, ?, NOW())", chunk.start.String(), chunk.end.String())
+	return errors.Wrap(err, "failed to save backfill progress")
+}
+
+// Run replicates every chunk which has not been completed yet. Workers stop
+// picking up new chunks once stopCtx is cancelled; cancelling abortCtx rolls
+// back the batches currently being committed.
+func (b *Backfill) Run(stopCtx context.Context, abortCtx context.Context, pgConn *sql.DB, sdbConn *sql.DB) error {
+	if b.EndHeight.Cmp(b.StartHeight) < 0 {
+		return errors.Errorf("end height %s is below start height %s", b.EndHeight, b.StartHeight)
+	}
+	if b.ChunkSize < 1 || b.Workers < 1 || b.BatchSize < 1 {
+		return errors.New("chunk size, workers and batch size must be positive")
+	}
+
+	completed, err := readCompletedChunks(stopCtx, sdbConn, b.StartHeight, b.EndHeight)
+	if err != nil {
+		return err
+	}
+
+	chunks := splitHeights(b.StartHeight, b.EndHeight, b.ChunkSize)
+	pending := make([]heightRange, 0, len(chunks))
+	for _, chunk := range chunks {
+		if !completed[chunk.start.String()+":"+chunk.end.String()] {
+			pending = append(pending, chunk)
+		}
+	}
+	log.Printf("backfilling blocks %s to %s: %d chunks remaining (%d already completed)",
+		b.StartHeight, b.EndHeight, len(pending), len(chunks)-len(pending))
+	MetricBackfillChunksRemaining.Set(float64(len(pending)))
+
+	ctx, cancel := context.WithCancel(abortCtx)
+	defer cancel()
+
+	work := make(chan heightRange)
+	errs := make(chan error, b.Workers)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < b.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range work {
+				// retries resume from the last committed batch rather than
+				// re-replicating the whole chunk
+				next := chunk.start
+				var done bool
+				err := Retry(stopCtx, b.Retry, "backfill", func() error {
+					var err error
+					next, done, err = b.replicateChunk(stopCtx, ctx, pgConn, sdbConn, chunk, next)
+					return err
+				})
+				if err != nil {
+					errs <- errors.Wrapf(err, "failed to backfill blocks %s to %s", chunk.start, chunk.end)
+					cancel()
+					return
+				}
+				if done {
+					MetricBackfillChunksRemaining.Dec()
+				}
+			}
+		}()
+	}
+
+outer:
+	for _, chunk := range pending {
+		select {
+		case work <- chunk:
+		case <-stopCtx.Done():
+			break outer
+		case <-ctx.Done():
+			break outer
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	select {
+	case err = <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// replicateChunk replicates chunk from next, returning the height to resume
+// from if it fails or is stopped.
+func (b *Backfill) replicateChunk(stopCtx context.Context, ctx context.Context, pgConn *sql.DB, sdbConn *sql.DB, chunk heightRange, next *big.Int) (*big.Int, bool, error) {
+	next, done, err := ReplicateRange(stopCtx, ctx, pgConn, sdbConn, next, chunk.end, b.BatchSize, b.Options)
+	if err != nil || !done {
+		return next, false, err
+	}
+
+	log.Printf("backfilled blocks %s to %s", chunk.start, chunk.end)
+	return next, true, writeCompletedChunk(ctx, sdbConn, chunk)
+}
@@ -0,0 +1,32 @@
+package src
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestSplitHeights(t *testing.T) {
+	tests := []struct {
+		start, end int64
+		size       int64
+		want       [][2]int64
+	}{
+		{0, 9, 5, [][2]int64{{0, 4}, {5, 9}}},
+		{0, 10, 5, [][2]int64{{0, 4}, {5, 9}, {10, 10}}},
+		{7, 7, 100, [][2]int64{{7, 7}}},
+		{3, 5, 1, [][2]int64{{3, 3}, {4, 4}, {5, 5}}},
+		{10, 9, 5, nil},
+	}
+	for _, tt := range tests {
+		got := splitHeights(big.NewInt(tt.start), big.NewInt(tt.end), tt.size)
+		if len(got) != len(tt.want) {
+			t.Errorf("splitHeights(%d, %d, %d) returned %d ranges, want %d", tt.start, tt.end, tt.size, len(got), len(tt.want))
+			continue
+		}
+		for i, r := range got {
+			if r.start.Int64() != tt.want[i][0] || r.end.Int64() != tt.want[i][1] {
+				t.Errorf("splitHeights(%d, %d, %d)[%d] = %s-%s, want %d-%d", tt.start, tt.end, tt.size, i, r.start, r.end, tt.want[i][0], tt.want[i][1])
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package src
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BatchSizer adapts the number of blocks replicated per batch so that each
+// batch takes roughly TargetDuration and contains roughly TargetRows rows. If
+// neither target is set the batch size stays fixed. It is safe for concurrent
+// use.
+type BatchSizer struct {
+	Min            int
+	Max            int
+	TargetDuration time.Duration
+	TargetRows     int
+
+	mu    sync.Mutex
+	limit int
+}
+
+// NewBatchSizer returns a sizer starting at initial blocks per batch. The
+// bounds only apply when a target is set.
+func NewBatchSizer(initial, min, max int, targetDuration time.Duration, targetRows int) (*BatchSizer, error) {
+	if min < 1 {
+		return nil, errors.Errorf("minimum batch size %d must be positive", min)
+	}
+	if min > max {
+		return nil, errors.Errorf("minimum batch size %d is above maximum batch size %d", min, max)
+	}
+
+	b := &BatchSizer{
+		Min:            min,
+		Max:            max,
+		TargetDuration: targetDuration,
+		TargetRows:     targetRows,
+	}
+	b.setLimit(initial)
+	return b, nil
+}
+
+// adapting reports whether the limit is adjusted towards a target.
+func (b *BatchSizer) adapting() bool {
+	return b.TargetDuration > 0 || b.TargetRows > 0
+}
+
+// Limit returns the maximum number of blocks to replicate in the next batch.
+func (b *BatchSizer) Limit() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit
+}
+
+func (b *BatchSizer) setLimit(limit int) {
+	if b.adapting() {
+		if limit < b.Min {
+			limit = b.Min
+		}
+		if limit > b.Max {
+			limit = b.Max
+		}
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	b.limit = limit
+	MetricBatchSize.Set(float64(limit))
+}
+
+// Observe records the result of a replicated batch and adjusts the limit
+// towards the configured targets.
+func (b *BatchSizer) Observe(blocks int, rows int, duration time.Duration) {
+	if blocks == 0 {
+		return
+	}
+
+	ratio := math.Inf(1)
+	if b.TargetDuration > 0 && duration > 0 {
+		ratio = float64(b.TargetDuration) / float64(duration)
+	}
+	if b.TargetRows > 0 && rows > 0 {
+		ratio = math.Min(ratio, float64(b.TargetRows)/float64(rows))
+	}
+	if math.IsInf(ratio, 1) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// a partial batch means we have caught up with postgres, so it says
+	// nothing about whether a bigger batch would still meet the targets
+	if ratio > 1 && blocks < b.limit {
+		return
+	}
+
+	// move at most a factor of two per batch to avoid oscillating on a
+	// single unusually fast or slow batch
+	next := float64(blocks) * ratio
+	next = math.Max(float64(b.limit)/2, math.Min(float64(b.limit)*2, next))
+
+	b.setLimit(int(math.Round(next)))
+}
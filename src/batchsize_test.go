@@ -0,0 +1,74 @@
+package src
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewBatchSizerBounds(t *testing.T) {
+	tests := []struct {
+		min, max int
+		ok       bool
+	}{
+		{1, 10000, true},
+		{100, 100, true},
+		{0, 100, false},
+		{200, 100, false},
+	}
+	for _, tt := range tests {
+		_, err := NewBatchSizer(100, tt.min, tt.max, time.Second, 0)
+		if (err == nil) != tt.ok {
+			t.Errorf("NewBatchSizer(min %d, max %d): got error %v, want ok %v", tt.min, tt.max, err, tt.ok)
+		}
+	}
+}
+
+func TestBatchSizerFixedWithoutTarget(t *testing.T) {
+	b, err := NewBatchSizer(20000, 1, 10000, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Limit(); got != 20000 {
+		t.Fatalf("initial limit = %d, want 20000", got)
+	}
+	b.Observe(20000, 1000000, time.Hour)
+	if got := b.Limit(); got != 20000 {
+		t.Fatalf("limit after observe = %d, want 20000", got)
+	}
+}
+
+func TestBatchSizerObserve(t *testing.T) {
+	tests := []struct {
+		name           string
+		initial        int
+		min, max       int
+		targetDuration time.Duration
+		targetRows     int
+		blocks, rows   int
+		duration       time.Duration
+		want           int
+	}{
+		{"too slow", 100, 1, 10000, time.Second, 0, 100, 0, 2 * time.Second, 50},
+		{"slow moves at most half", 100, 1, 10000, time.Second, 0, 100, 0, 10 * time.Second, 50},
+		{"fast moves at most double", 100, 1, 10000, time.Second, 0, 100, 0, time.Second / 10, 200},
+		{"fast capped at max", 100, 1, 150, time.Second, 0, 100, 0, time.Second / 10, 150},
+		{"slow capped at min", 100, 80, 10000, time.Second, 0, 100, 0, 10 * time.Second, 80},
+		{"too many rows", 100, 1, 10000, 0, 1000, 100, 1250, time.Second, 80},
+		{"slowest target wins", 100, 1, 10000, time.Second, 1000, 100, 500, 4 * time.Second / 3, 75},
+		{"partial batch does not grow", 100, 1, 10000, time.Second, 0, 10, 0, time.Second / 10, 100},
+		{"partial batch still shrinks", 100, 1, 10000, time.Second, 0, 60, 0, 2 * time.Second, 50},
+		{"empty batch", 100, 1, 10000, time.Second, 0, 0, 0, time.Second, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := NewBatchSizer(tt.initial, tt.min, tt.max, tt.targetDuration, tt.targetRows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.Observe(tt.blocks, tt.rows, tt.duration)
+			if got := b.Limit(); got != tt.want {
+				t.Errorf("limit = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
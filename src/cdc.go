@@ -0,0 +1,499 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const (
+	// standbyStatusInterval is how often we report our position to Postgres
+	// even if nothing has been committed
+	standbyStatusInterval = 10 * time.Second
+
+	// cdcReceiveTimeout bounds how long we block waiting for a message so
+	// that flushes and shutdown are noticed promptly
+	cdcReceiveTimeout = time.Second
+
+	// duplicateObject is the Postgres error code returned when creating a
+	// replication slot which already exists
+	duplicateObject = "42710"
+)
+
+type cdcRelation struct {
+	model   ModelInfo
+	columns []*pglogrepl.RelationMessageColumn
+
+	// fields maps each column name to the corresponding golang field name
+	fields map[string]string
+}
+
+// CDCSource replicates from a Postgres logical replication slot rather than
+// polling the blocks table. Rows are decoded from the pgoutput change stream
+// into the same models used by Replicate, which means updates to mutable
+// tables like accounts and access_keys are picked up as they happen.
+type CDCSource struct {
+	conn      *pgconn.PgConn
+	sink      Sink
+	config    CDCConfig
+	relations map[uint32]*cdcRelation
+	models    map[string]ModelInfo
+	tables    *TableGraph
+
+	// committedLSN is the position of the last transaction which has been
+	// committed to SingleStore
+	committedLSN pglogrepl.LSN
+
+	// committedHeight is the highest block committed to SingleStore, read
+	// from replication_meta when the source starts, used as the start of the
+	// next replicated range
+	committedHeight *big.Int
+
+	loader           *Loader
+	pendingLSN       pglogrepl.LSN
+	pendingBlocks    int
+	pendingMinHeight *big.Int
+	pendingHeight    *big.Int
+	pendingSince     time.Time
+	inTxn            bool
+}
+
+// NewCDCSource connects to the replication slot, creating it if needed. Only
+// changes to the tables loaded by tables are replicated. The first range
+// recorded in replication_meta starts after the highest block already in it
+// in sdbConn.
+func NewCDCSource(ctx context.Context, pgConfig ConnectionConfig, config CDCConfig, sdbConn *sql.DB, sink Sink, tables *TableGraph) (*CDCSource, error) {
+	if config.Slot == "" || config.Publication == "" {
+		return nil, errors.New("cdc.slot and cdc.publication are required in cdc mode")
+	}
+
+	committedHeight, err := readCommittedHeight(sdbConn)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := ConnectPostgresReplication(ctx, pgConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open replication connection to postgres")
+	}
+
+	_, err = pglogrepl.CreateReplicationSlot(ctx, conn, config.Slot, "pgoutput", pglogrepl.CreateReplicationSlotOptions{})
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == duplicateObject {
+		err = nil
+	} else if err == nil {
+		log.Printf("created replication slot %s", config.Slot)
+	}
+	if err != nil {
+		conn.Close(context.Background())
+		return nil, errors.Wrapf(err, "unable to create replication slot %s", config.Slot)
+	}
+
+	models := make(map[string]ModelInfo)
+	for _, model := range Models {
+		if tables.Loads(model.Table) {
+			models[model.Table] = model
+		}
+	}
+
+	err = checkReplicaIdentity(ctx, conn, config.Publication, models)
+	if err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+
+	return &CDCSource{
+		conn:            conn,
+		sink:            sink,
+		config:          config,
+		relations:       make(map[uint32]*cdcRelation),
+		models:          models,
+		tables:          tables,
+		committedHeight: committedHeight,
+	}, nil
+}
+
+// readCommittedHeight returns the highest block recorded in replication_meta,
+// or nil if nothing has been replicated yet.
+func readCommittedHeight(sdbConn *sql.DB) (*big.Int, error) {
+	height, err := ReadMaxReplicatedBlockHeight(sdbConn)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read highest block from singlestore")
+	}
+	if height.Sign() == 0 {
+		return nil, nil
+	}
+	return height, nil
+}
+
+// checkReplicaIdentity checks that every replicated table is published with
+// REPLICA IDENTITY FULL. pgoutput leaves unchanged TOAST values, such as a
+// large args column, out of updated rows, and they can only be recovered from
+// the old row which is only sent in full with that setting.
+func checkReplicaIdentity(ctx context.Context, conn *pgconn.PgConn, publication string, models map[string]ModelInfo) error {
+	results, err := conn.Exec(ctx, fmt.Sprintf(`
+		select p.tablename, c.relreplident
+		from pg_publication_tables p
+		join pg_namespace n on n.nspname = p.schemaname
+		join pg_class c on c.relnamespace = n.oid and c.relname = p.tablename
+		where p.pubname = %s`, pq.QuoteLiteral(publication))).ReadAll()
+	if err != nil {
+		return errors.Wrap(err, "failed to read the tables of the publication")
+	}
+
+	identity := make(map[string]string)
+	for _, result := range results {
+		for _, row := range result.Rows {
+			identity[string(row[0])] = string(row[1])
+		}
+	}
+
+	var missing, notFull []string
+	for table := range models {
+		switch identity[table] {
+		case "f":
+		case "":
+			missing = append(missing, table)
+		default:
+			notFull = append(notFull, table)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(notFull)
+	if len(missing) > 0 {
+		return errors.Errorf("publication %s does not include %s", publication, strings.Join(missing, ", "))
+	}
+	if len(notFull) > 0 {
+		return errors.Errorf("tables %s must have REPLICA IDENTITY FULL so that unchanged TOAST values can be replicated", strings.Join(notFull, ", "))
+	}
+	return nil
+}
+
+func (c *CDCSource) Close() error {
+	if c.loader != nil {
+		c.loader.Abort()
+		c.loader = nil
+	}
+	return c.conn.Close(context.Background())
+}
+
+// Run consumes the replication slot until stopCtx is cancelled. Changes are
+// buffered until either batchSize blocks have been received or flushInterval
+// has elapsed, and are then committed to SingleStore at a Postgres
+// transaction boundary. The slot only advances once a batch has committed,
+// so a crash replays the uncommitted changes. Cancelling abortCtx rolls back
+// the batch currently being committed.
+func (c *CDCSource) Run(stopCtx context.Context, abortCtx context.Context, batchSize int, flushInterval time.Duration) error {
+	err := pglogrepl.StartReplication(stopCtx, c.conn, c.config.Slot, 0, pglogrepl.StartReplicationOptions{
+		PluginArgs: []string{
+			"proto_version '1'",
+			"publication_names '" + c.config.Publication + "'",
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to start logical replication")
+	}
+	log.Printf("started logical replication from slot %s", c.config.Slot)
+
+	nextStatus := time.Now().Add(standbyStatusInterval)
+	for {
+		if !c.inTxn && c.loader != nil && (stopCtx.Err() != nil || time.Since(c.pendingSince) >= flushInterval) {
+			err = c.flush(abortCtx)
+			if err != nil {
+				return err
+			}
+			nextStatus = time.Time{}
+		}
+		if !c.inTxn && stopCtx.Err() != nil {
+			return c.sendStatus(context.Background())
+		}
+
+		if time.Now().After(nextStatus) {
+			err = c.sendStatus(abortCtx)
+			if err != nil {
+				return err
+			}
+			nextStatus = time.Now().Add(standbyStatusInterval)
+		}
+
+		recvCtx, cancel := context.WithTimeout(abortCtx, cdcReceiveTimeout)
+		msg, err := c.conn.ReceiveMessage(recvCtx)
+		cancel()
+		if err != nil {
+			if abortCtx.Err() == nil && pgconn.Timeout(err) {
+				continue
+			}
+			return errors.Wrap(err, "failed to receive replication message")
+		}
+
+		copyData, ok := msg.(*pgproto3.CopyData)
+		if !ok {
+			return errors.Errorf("received unexpected replication message: %#v", msg)
+		}
+
+		switch copyData.Data[0] {
+		case pglogrepl.PrimaryKeepaliveMessageByteID:
+			pkm, err := pglogrepl.ParsePrimaryKeepaliveMessage(copyData.Data[1:])
+			if err != nil {
+				return errors.Wrap(err, "failed to parse keepalive message")
+			}
+			if pkm.ReplyRequested {
+				nextStatus = time.Time{}
+			}
+
+		case pglogrepl.XLogDataByteID:
+			xld, err := pglogrepl.ParseXLogData(copyData.Data[1:])
+			if err != nil {
+				return errors.Wrap(err, "failed to parse xlog data")
+			}
+			logicalMsg, err := pglogrepl.Parse(xld.WALData)
+			if err != nil {
+				return errors.Wrap(err, "failed to parse logical replication message")
+			}
+			err = c.handle(logicalMsg)
+			if err != nil {
+				return err
+			}
+			if !c.inTxn && c.loader != nil && c.pendingBlocks >= batchSize {
+				err = c.flush(abortCtx)
+				if err != nil {
+					return err
+				}
+				nextStatus = time.Time{}
+			}
+		}
+	}
+}
+
+func (c *CDCSource) handle(msg pglogrepl.Message) error {
+	switch m := msg.(type) {
+	case *pglogrepl.RelationMessage:
+		model, ok := c.models[m.RelationName]
+		if !ok {
+			// not a table we replicate
+			delete(c.relations, m.RelationID)
+			return nil
+		}
+		fields := make(map[string]string)
+		for fieldName, columnName := range model.FieldMap {
+			fields[columnName] = fieldName
+		}
+		c.relations[m.RelationID] = &cdcRelation{
+			model:   model,
+			columns: m.Columns,
+			fields:  fields,
+		}
+
+	case *pglogrepl.BeginMessage:
+		c.inTxn = true
+
+	case *pglogrepl.CommitMessage:
+		c.inTxn = false
+		if c.loader != nil {
+			c.pendingLSN = m.TransactionEndLSN
+		} else {
+			// nothing we care about happened in this transaction so it is
+			// safe to acknowledge it straight away
+			c.committedLSN = m.TransactionEndLSN
+		}
+
+	case *pglogrepl.InsertMessage:
+		return c.writeTuple(m.RelationID, m.Tuple)
+
+	case *pglogrepl.UpdateMessage:
+		return c.writeTuple(m.RelationID, withUnchangedToast(m.NewTuple, m.OldTuple))
+
+	case *pglogrepl.DeleteMessage:
+		return c.deleteTuple(m.RelationID, m.OldTuple)
+	}
+
+	return nil
+}
+
+// withUnchangedToast fills the unchanged TOAST values of an updated row, which
+// pgoutput leaves out, from the old row. The old row has every column when
+// the table has REPLICA IDENTITY FULL.
+func withUnchangedToast(tuple *pglogrepl.TupleData, old *pglogrepl.TupleData) *pglogrepl.TupleData {
+	if tuple == nil || old == nil || len(old.Columns) != len(tuple.Columns) {
+		return tuple
+	}
+
+	var out *pglogrepl.TupleData
+	for i, col := range tuple.Columns {
+		if col.DataType != pglogrepl.TupleDataTypeToast || old.Columns[i].DataType == pglogrepl.TupleDataTypeToast {
+			continue
+		}
+		if out == nil {
+			out = &pglogrepl.TupleData{ColumnNum: tuple.ColumnNum, Columns: append([]*pglogrepl.TupleDataColumn{}, tuple.Columns...)}
+		}
+		out.Columns[i] = old.Columns[i]
+	}
+	if out == nil {
+		return tuple
+	}
+	return out
+}
+
+func (c *CDCSource) writeTuple(relationID uint32, tuple *pglogrepl.TupleData) error {
+	rel, ok := c.relations[relationID]
+	if !ok {
+		return nil
+	}
+
+	row, err := rel.decode(tuple, false)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decode row from %s", rel.model.Table)
+	}
+
+	if block, ok := row.(*Block); ok {
+		// changes are streamed as soon as they are committed, so there is no
+		// confirmation depth in cdc mode
+		block.Finalized = true
+	}
+
+	err = c.ensureLoader()
+	if err != nil {
+		return err
+	}
+	err = c.loader.WriteRow(rel.model.Table, row)
+	if err != nil {
+		return errors.Wrap(err, "failed to write row to loader")
+	}
+	MetricReplicatedRows.Inc()
+
+	if block, ok := row.(*Block); ok {
+		height := block.Height()
+		if c.pendingHeight == nil || height.Cmp(c.pendingHeight) > 0 {
+			c.pendingHeight = height
+		}
+		if c.pendingMinHeight == nil || height.Cmp(c.pendingMinHeight) < 0 {
+			c.pendingMinHeight = height
+		}
+		c.pendingBlocks++
+		MetricReplicatedBlocks.Inc()
+	}
+
+	return nil
+}
+
+func (c *CDCSource) ensureLoader() error {
+	if c.loader == nil {
+		loader, err := NewLoader(c.sink, c.tables)
+		if err != nil {
+			return errors.Wrap(err, "failed to open batch")
+		}
+		c.loader = loader
+		c.pendingSince = time.Now()
+	}
+	return nil
+}
+
+// deleteTuple deletes a row from one of the tables in deleteKeys. Deletes
+// from every other table are ignored. In particular chain reorganizations are
+// not handled in cdc mode: when the indexer deletes orphaned blocks, they and
+// the rows which belong to them are left in SingleStore, and replicating with
+// --source poll is needed to rewind them.
+func (c *CDCSource) deleteTuple(relationID uint32, tuple *pglogrepl.TupleData) error {
+	rel, ok := c.relations[relationID]
+	if !ok || tuple == nil {
+		return nil
+	}
+	if rel.model.Table == RootTable {
+		log.Printf("a block was deleted from postgres, most likely by a chain reorganization which cdc mode does not rewind; restart with --source poll to rewind SingleStore")
+		return nil
+	}
+	if _, ok := deleteKeys[rel.model.Table]; !ok {
+		return nil
+	}
+
+	// the old tuple only contains the replica identity, which defaults to
+	// the primary key
+	row, err := rel.decode(tuple, true)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decode deleted row from %s", rel.model.Table)
+	}
+
+	err = c.ensureLoader()
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(c.loader.Delete(rel.model.Table, row), "failed to delete row")
+}
+
+// decode converts a tuple into a model. If keyOnly is set null columns are
+// left unset rather than rejected, since only the key columns are sent for
+// deleted rows.
+func (r *cdcRelation) decode(tuple *pglogrepl.TupleData, keyOnly bool) (Model, error) {
+	row := r.model.New()
+	v := reflect.ValueOf(row).Elem()
+
+	for i, col := range tuple.Columns {
+		fieldName, ok := r.fields[r.columns[i].Name]
+		if !ok {
+			// postgres has columns we don't replicate
+			continue
+		}
+		field := v.FieldByName(fieldName)
+
+		switch col.DataType {
+		case pglogrepl.TupleDataTypeNull:
+			if field.Kind() != reflect.Ptr && !keyOnly {
+				return nil, errors.Errorf("column %s is unexpectedly null", r.columns[i].Name)
+			}
+		case pglogrepl.TupleDataTypeText:
+			err := setField(field, string(col.Data))
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read column %s", r.columns[i].Name)
+			}
+		case pglogrepl.TupleDataTypeToast:
+			return nil, errors.Errorf("column %s was not included in the change because it is an unchanged TOAST value; set REPLICA IDENTITY FULL on %s", r.columns[i].Name, r.model.Table)
+		}
+	}
+
+	return row, nil
+}
+
+func (c *CDCSource) flush(ctx context.Context) error {
+	start := time.Now()
+
+	startHeight := c.pendingMinHeight
+	if c.committedHeight != nil && c.pendingMinHeight != nil && c.committedHeight.Cmp(c.pendingMinHeight) < 0 {
+		startHeight = (&big.Int{}).Add(c.committedHeight, big.NewInt(1))
+	}
+
+	err := c.loader.Commit(ctx, startHeight, c.pendingHeight)
+	if err != nil {
+		return errors.Wrap(err, "failed to commit the load")
+	}
+
+	MetricBatchReplicationTime.Observe(time.Since(start).Seconds())
+
+	c.committedLSN = c.pendingLSN
+	if c.pendingHeight != nil {
+		c.committedHeight = c.pendingHeight
+	}
+	c.loader = nil
+	c.pendingBlocks = 0
+	c.pendingMinHeight = nil
+	c.pendingHeight = nil
+	return nil
+}
+
+func (c *CDCSource) sendStatus(ctx context.Context) error {
+	err := pglogrepl.SendStandbyStatusUpdate(ctx, c.conn, pglogrepl.StandbyStatusUpdate{
+		WALWritePosition: c.committedLSN,
+	})
+	return errors.Wrap(err, "failed to send standby status update")
+}
@@ -0,0 +1,122 @@
+package src
+
+import (
+	"context"
+	"database/sql/driver"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pglogrepl"
+)
+
+func tuple(cols ...string) *pglogrepl.TupleData {
+	t := &pglogrepl.TupleData{ColumnNum: uint16(len(cols))}
+	for _, c := range cols {
+		switch c {
+		case "<toast>":
+			t.Columns = append(t.Columns, &pglogrepl.TupleDataColumn{DataType: pglogrepl.TupleDataTypeToast})
+		case "<null>":
+			t.Columns = append(t.Columns, &pglogrepl.TupleDataColumn{DataType: pglogrepl.TupleDataTypeNull})
+		default:
+			t.Columns = append(t.Columns, &pglogrepl.TupleDataColumn{DataType: pglogrepl.TupleDataTypeText, Length: uint32(len(c)), Data: []byte(c)})
+		}
+	}
+	return t
+}
+
+func tupleStrings(t *pglogrepl.TupleData) []string {
+	out := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		switch c.DataType {
+		case pglogrepl.TupleDataTypeToast:
+			out[i] = "<toast>"
+		case pglogrepl.TupleDataTypeNull:
+			out[i] = "<null>"
+		default:
+			out[i] = string(c.Data)
+		}
+	}
+	return out
+}
+
+func TestWithUnchangedToast(t *testing.T) {
+	tests := []struct {
+		name string
+		new  *pglogrepl.TupleData
+		old  *pglogrepl.TupleData
+		want []string
+	}{
+		{"no old row", tuple("a", "<toast>"), nil, []string{"a", "<toast>"}},
+		{"filled from old row", tuple("a", "<toast>", "c"), tuple("x", "big", "z"), []string{"a", "big", "c"}},
+		{"old row is toast too", tuple("a", "<toast>"), tuple("a", "<toast>"), []string{"a", "<toast>"}},
+		{"old null", tuple("a", "<toast>"), tuple("a", "<null>"), []string{"a", "<null>"}},
+		{"nothing to fill", tuple("a", "b"), tuple("x", "y"), []string{"a", "b"}},
+		{"old row with key only", tuple("a", "<toast>"), tuple("a"), []string{"a", "<toast>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := tupleStrings(tt.new)
+			got := tupleStrings(withUnchangedToast(tt.new, tt.old))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+			after := tupleStrings(tt.new)
+			for i := range before {
+				if before[i] != after[i] {
+					t.Fatalf("new tuple was modified: %v became %v", before, after)
+				}
+			}
+		})
+	}
+}
+
+func TestCDCFlushStartsAfterCheckpoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		replicated string
+		want       string
+	}{
+		{"after a restart", "100", "commit 101-130 []"},
+		{"nothing replicated", "0", "commit 120-130 []"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sdbConn, _ := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+				if strings.HasPrefix(query, "SELECT coalesce(MAX(block_height), 0) FROM replication_meta") {
+					return []string{"coalesce"}, [][]string{{tt.replicated}}, nil
+				}
+				return nil, nil, nil
+			})
+			committedHeight, err := readCommittedHeight(sdbConn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sink := &recordingSink{}
+			loader, err := NewLoader(sink, DefaultTableGraph)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &CDCSource{
+				committedHeight:  committedHeight,
+				loader:           loader,
+				pendingMinHeight: big.NewInt(120),
+				pendingHeight:    big.NewInt(130),
+			}
+			err = c.flush(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{tt.want}; !reflect.DeepEqual(sink.events, want) {
+				t.Errorf("committed %v, want %v", sink.events, want)
+			}
+		})
+	}
+}
@@ -1,8 +1,10 @@
 package src
 
 import (
+	"database/sql"
 	"os"
 
+	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
 
@@ -18,10 +20,95 @@ type MetricsConfig struct {
 	Port int `yaml:"port"`
 }
 
+// CDCConfig configures replication from a Postgres logical replication slot
+// using the pgoutput plugin. The publication must already exist.
+type CDCConfig struct {
+	Slot        string `yaml:"slot"`
+	Publication string `yaml:"publication"`
+}
+
+// TablesConfig limits which tables are replicated. An empty Include list
+// includes every table.
+type TablesConfig struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// Graph returns the table graph which loads the configured tables. Parents of
+// the replicated tables are still read from Postgres for the keys of their
+// children when they are not replicated themselves.
+func (c TablesConfig) Graph() (*TableGraph, error) {
+	g, err := DefaultTableGraph.Select(c.Include, c.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	if !g.Loads(RootTable) {
+		return nil, errors.Errorf("%s must be replicated, it is used to track the chain", RootTable)
+	}
+	return g, nil
+}
+
+// ParquetConfig configures exporting every replicated batch as Parquet files
+// alongside SingleStore
+type ParquetConfig struct {
+	// Dir is the directory the files are written to. Empty disables the
+	// export.
+	Dir string `yaml:"dir"`
+}
+
+// ArchiveConfig configures keeping a copy of every replicated batch as Avro
+// files, which the replay command loads back into SingleStore
+type ArchiveConfig struct {
+	// Dir is the directory the batches are written to. Empty disables the
+	// archive.
+	Dir string `yaml:"dir"`
+}
+
 type Config struct {
 	Postgres    ConnectionConfig `yaml:"postgres"`
 	SingleStore ConnectionConfig `yaml:"singlestore"`
 	Metrics     MetricsConfig    `yaml:"metrics"`
+	CDC         CDCConfig        `yaml:"cdc"`
+	Tables      TablesConfig     `yaml:"tables"`
+	Parquet     ParquetConfig    `yaml:"parquet"`
+	Archive     ArchiveConfig    `yaml:"archive"`
+
+	// Accounts limits replication of account activity to these account IDs
+	// or suffix patterns like *.near. Empty means every account.
+	Accounts []string `yaml:"accounts"`
+}
+
+// ExtractOptions returns the options for reading batches which are set by
+// the config file.
+func (c *Config) ExtractOptions() (ExtractOptions, error) {
+	tables, err := c.Tables.Graph()
+	if err != nil {
+		return ExtractOptions{}, errors.Wrap(err, "invalid tables config")
+	}
+
+	opts := ExtractOptions{Tables: tables}
+	if len(c.Accounts) > 0 {
+		opts.Accounts, err = NewAccountFilter(c.Accounts)
+		if err != nil {
+			return ExtractOptions{}, errors.Wrap(err, "invalid accounts config")
+		}
+	}
+	return opts, nil
+}
+
+// Sink returns the sink replicated batches are committed to: SingleStore,
+// preceded by the archive and any exports set by the config file.
+func (c *Config) Sink(sdbConn *sql.DB) Sink {
+	sink := Sink(NewSingleStoreSink(sdbConn))
+	if c.Parquet.Dir != "" {
+		// parquet files are written first so that every batch in the
+		// checkpoint has been exported
+		sink = NewTeeSink(NewParquetSink(c.Parquet.Dir), sink)
+	}
+	if c.Archive.Dir != "" {
+		sink = NewTeeSink(NewArchiveSink(c.Archive.Dir), sink)
+	}
+	return sink
 }
 
 func ParseConfig(filename string) (*Config, error) {
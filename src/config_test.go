@@ -0,0 +1,35 @@
+package src
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTablesConfigGraph(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TablesConfig
+		err    string
+	}{
+		{"everything", TablesConfig{}, ""},
+		{"parent and child", TablesConfig{Include: []string{"blocks", "transactions", "transaction_actions"}}, ""},
+		{"no blocks", TablesConfig{Exclude: []string{"blocks"}}, "blocks must be replicated"},
+		{"child without parent", TablesConfig{Include: []string{"blocks", "transaction_actions"}}, ""},
+		{"excluded parent", TablesConfig{Exclude: []string{"receipts"}}, ""},
+		{"excluded subtree", TablesConfig{Exclude: []string{"transactions", "transaction_actions"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.config.Graph()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
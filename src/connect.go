@@ -1,11 +1,13 @@
 package src
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/stdlib"
 )
 
@@ -32,6 +34,28 @@ func ConnectPostgres(config ConnectionConfig) (*sql.DB, error) {
 	return db, nil
 }
 
+// ConnectPostgresReplication opens a logical replication connection to
+// Postgres.
+func ConnectPostgresReplication(ctx context.Context, config ConnectionConfig) (*pgconn.PgConn, error) {
+	pgURL := fmt.Sprintf(
+		"postgres://%s:%s@%s:%d/%s?replication=database",
+		config.Username, config.Password,
+		config.Host, config.Port, config.Database)
+
+	return pgconn.Connect(ctx, pgURL)
+}
+
+// ConnectPostgresConn opens a single low level connection to Postgres, for
+// features database/sql does not expose such as COPY.
+func ConnectPostgresConn(ctx context.Context, config ConnectionConfig) (*pgconn.PgConn, error) {
+	pgURL := fmt.Sprintf(
+		"postgres://%s:%s@%s:%d/%s",
+		config.Username, config.Password,
+		config.Host, config.Port, config.Database)
+
+	return pgconn.Connect(ctx, pgURL)
+}
+
 func ConnectSingleStore(config ConnectionConfig) (*sql.DB, error) {
 	// We use NewConfig here to set default values. Then we override what we need to.
 	mysqlConf := mysql.NewConfig()
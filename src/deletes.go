@@ -0,0 +1,194 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// deleteKeys lists the tables which rows can be deleted from, along with the
+// fields which identify a row in each of them. Every other table is only
+// ever appended to by the indexer.
+var deleteKeys = map[string][]string{
+	"access_keys":     {"PublicKey", "AccountId"},
+	"account_changes": {"Id"},
+	"accounts":        {"Id"},
+}
+
+// deleteChunkSize is the maximum number of rows deleted per statement
+const deleteChunkSize = 500
+
+func (s *Stream) deleteRows(ctx context.Context, tx *sql.Tx, rows map[string]Model) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(rows))
+	for key := range rows {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	conditions := make([]string, 0, len(s.keyFields))
+	for _, field := range s.keyFields {
+		conditions = append(conditions, s.model.FieldMap[field]+" = ?")
+	}
+	condition := "(" + strings.Join(conditions, " AND ") + ")"
+
+	for start := 0; start < len(keys); start += deleteChunkSize {
+		end := start + deleteChunkSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		where := make([]string, 0, end-start)
+		args := make([]interface{}, 0, (end-start)*len(s.keyFields))
+		for _, key := range keys[start:end] {
+			v := reflect.ValueOf(rows[key]).Elem()
+			for _, field := range s.keyFields {
+				args = append(args, formatField(v.FieldByName(field)))
+			}
+			where = append(where, condition)
+		}
+
+		result, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s", s.table, strings.Join(where, " OR ")), args...)
+		if err != nil {
+			return err
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		s.deleted += deleted
+	}
+	return nil
+}
+
+// readKeys returns the string value of every column of every row returned by
+// query.
+func readKeys(ctx context.Context, db querier, query string, args ...interface{}) ([][]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([][]string, 0)
+	for rows.Next() {
+		values := make([]string, len(columns))
+		dst := make([]interface{}, len(columns))
+		for i := range values {
+			dst[i] = &values[i]
+		}
+		err = rows.Scan(dst...)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, values)
+	}
+	return out, rows.Err()
+}
+
+// reconcileTable deletes the rows selected by sdbQuery which are no longer in
+// Postgres, unless table is not loaded by tables. Both queries must select the
+// key columns of the table in the order of deleteKeys, and pgQuery is passed
+// one array of values per key column. sdbQuery may only read table itself,
+// since its parents may not be loaded.
+func reconcileTable(ctx context.Context, pgTx querier, sdbConn *sql.DB, loader *Loader, tables *TableGraph, table string, pgQuery string, sdbQuery string, sdbArgs ...interface{}) error {
+	if !tables.Loads(table) {
+		return nil
+	}
+	t, err := loader.table(table)
+	if err != nil {
+		return err
+	}
+
+	replicated, err := readKeys(ctx, sdbConn, sdbQuery, sdbArgs...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read replicated keys from %s", table)
+	}
+	if len(replicated) == 0 {
+		return nil
+	}
+
+	keyFields := deleteKeys[table]
+	columns := make([][]string, len(keyFields))
+	for _, key := range replicated {
+		for i := range keyFields {
+			columns[i] = append(columns[i], key[i])
+		}
+	}
+	pgArgs := make([]interface{}, 0, len(columns))
+	for _, column := range columns {
+		pgArgs = append(pgArgs, pq.Array(column))
+	}
+
+	existing, err := readKeys(ctx, pgTx, pgQuery, pgArgs...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read keys from %s", table)
+	}
+	exists := make(map[string]bool, len(existing))
+	for _, key := range existing {
+		exists[strings.Join(key, "\x00")] = true
+	}
+
+	model := t.model
+	for _, key := range replicated {
+		if exists[strings.Join(key, "\x00")] {
+			continue
+		}
+		row := model.New()
+		v := reflect.ValueOf(row).Elem()
+		for i, field := range keyFields {
+			err = setField(v.FieldByName(field), key[i])
+			if err != nil {
+				return errors.Wrapf(err, "failed to read replicated key of %s", table)
+			}
+		}
+		err = loader.Delete(table, row)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileDeletes finds rows in SingleStore which belong to the batch but
+// have since been deleted from Postgres, for example by the indexer
+// reindexing a range of blocks, and deletes them through the loader.
+func reconcileDeletes(ctx context.Context, pgTx querier, sdbConn *sql.DB, loader *Loader, tables *TableGraph, blocks []*Block, mutableStartHeight *big.Int, maxBlockHeight string) error {
+	err := reconcileTable(ctx, pgTx, sdbConn, loader, tables, "account_changes",
+		"select id from account_changes where id = ANY($1::bigint[])",
+		"SELECT id FROM account_changes WHERE changed_in_block_timestamp BETWEEN ? AND ?",
+		blocks[0].BlockTimestamp.RatString(), blocks[len(blocks)-1].BlockTimestamp.RatString())
+	if err != nil {
+		return err
+	}
+
+	// rows updated since they were replicated are still in postgres, just
+	// at a higher last_update_block_height, so they are looked up by key
+	err = reconcileTable(ctx, pgTx, sdbConn, loader, tables, "accounts",
+		"select id from accounts where id = ANY($1::bigint[])",
+		"SELECT id FROM accounts WHERE last_update_block_height BETWEEN ? AND ?",
+		mutableStartHeight.String(), maxBlockHeight)
+	if err != nil {
+		return err
+	}
+
+	return reconcileTable(ctx, pgTx, sdbConn, loader, tables, "access_keys",
+		"select public_key, account_id from access_keys where (public_key, account_id) in (select * from unnest($1::text[], $2::text[]))",
+		"SELECT public_key, account_id FROM access_keys WHERE last_update_block_height BETWEEN ? AND ?",
+		mutableStartHeight.String(), maxBlockHeight)
+}
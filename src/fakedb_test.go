@@ -0,0 +1,189 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDB is a database/sql driver for tests. Queries are answered by the
+// handler, and every statement along with the end of every transaction is
+// recorded in order.
+type fakeDB struct {
+	mu         sync.Mutex
+	statements []string
+
+	// handler returns the columns and rows of a query. Queries without a
+	// handler, or for which it returns no columns, have no rows.
+	handler func(query string, args []driver.Value) ([]string, [][]string, error)
+}
+
+var (
+	fakeDBsMu sync.Mutex
+	fakeDBs   = make(map[string]*fakeDB)
+)
+
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+}
+
+// openFakeDB returns a connection to a new fakeDB which answers queries with
+// handler.
+func openFakeDB(t *testing.T, handler func(query string, args []driver.Value) ([]string, [][]string, error)) (*sql.DB, *fakeDB) {
+	t.Helper()
+
+	fake := &fakeDB{handler: handler}
+	fakeDBsMu.Lock()
+	name := fmt.Sprintf("%s-%d", t.Name(), len(fakeDBs))
+	fakeDBs[name] = fake
+	fakeDBsMu.Unlock()
+
+	db, err := sql.Open("fakedb", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, fake
+}
+
+// Statements returns every statement run so far.
+func (f *fakeDB) Statements() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.statements...)
+}
+
+func (f *fakeDB) record(statement string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statements = append(f.statements, strings.Join(strings.Fields(statement), " "))
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBsMu.Lock()
+	defer fakeDBsMu.Unlock()
+	db, ok := fakeDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("no fake database named %s", name)
+	}
+	return &fakeConn{db: db}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.record("BEGIN")
+	return fakeTx{db: c.db}, nil
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Begin()
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.db.record(query)
+	if c.db.handler != nil {
+		_, _, err := c.db.handler(query, values(args))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.db.record(query)
+	rows := &fakeRows{}
+	if c.db.handler != nil {
+		var err error
+		rows.columns, rows.rows, err = c.db.handler(query, values(args))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+func values(args []driver.NamedValue) []driver.Value {
+	out := make([]driver.Value, len(args))
+	for i, arg := range args {
+		out[i] = arg.Value
+	}
+	return out
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, driver.ErrSkip
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, driver.ErrSkip
+}
+
+type fakeTx struct {
+	db *fakeDB
+}
+
+func (t fakeTx) Commit() error {
+	t.db.record("COMMIT")
+	return nil
+}
+
+func (t fakeTx) Rollback() error {
+	t.db.record("ROLLBACK")
+	return nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]string
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dst []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	for i, v := range r.rows[0] {
+		dst[i] = v
+	}
+	r.rows = r.rows[1:]
+	return nil
+}
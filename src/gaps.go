@@ -0,0 +1,120 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Gap is a range of block heights (inclusive) which lies between two ranges
+// recorded in replication_meta but is not covered by any of them.
+type Gap struct {
+	StartHeight *big.Int
+	EndHeight   *big.Int
+}
+
+// FindReplicationGaps returns every hole between the ranges recorded in
+// replication_meta in ascending order. Rows written before replication_meta
+// had a start_height are assumed to cover everything below them. Ranges are
+// read in order of their start, so a gap is the heights above every range
+// which starts before it and below the next range. Heights below the first
+// range are not a gap, since replication can start at any height.
+func FindReplicationGaps(ctx context.Context, sdbConn *sql.DB) ([]Gap, error) {
+	rows, err := sdbConn.QueryContext(ctx, `
+		SELECT COALESCE(start_height, 0), block_height FROM replication_meta
+		ORDER BY COALESCE(start_height, 0), block_height
+	`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query replication gaps")
+	}
+	defer rows.Close()
+
+	out := make([]Gap, 0)
+	var covered *big.Int
+	for rows.Next() {
+		var start, end string
+		err = rows.Scan(&start, &end)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan replicated range")
+		}
+		startHeight, endHeight := ParseBigInt(start), ParseBigInt(end)
+
+		if covered != nil {
+			next := (&big.Int{}).Add(covered, big.NewInt(1))
+			if startHeight.Cmp(next) > 0 {
+				out = append(out, Gap{StartHeight: next, EndHeight: (&big.Int{}).Sub(startHeight, big.NewInt(1))})
+			}
+		}
+		if covered == nil || endHeight.Cmp(covered) > 0 {
+			covered = endHeight
+		}
+	}
+	return out, rows.Err()
+}
+
+// CheckReplicationGaps finds the gaps in replication_meta, logs them and
+// updates the gap metrics.
+func CheckReplicationGaps(ctx context.Context, sdbConn *sql.DB) ([]Gap, error) {
+	gaps, err := FindReplicationGaps(ctx, sdbConn)
+	if err != nil {
+		return nil, err
+	}
+
+	heights := &big.Int{}
+	for _, gap := range gaps {
+		log.Printf("blocks %s to %s have not been replicated", gap.StartHeight, gap.EndHeight)
+		heights.Add(heights, gap.EndHeight)
+		heights.Sub(heights, gap.StartHeight)
+		heights.Add(heights, big.NewInt(1))
+	}
+
+	MetricReplicationGaps.Set(float64(len(gaps)))
+	MetricReplicationGapHeights.Set(float64(heights.Int64()))
+	return gaps, nil
+}
+
+// MonitorReplicationGaps checks for gaps in replication_meta every interval
+// until stopCtx is cancelled, or only once if interval is 0. If heal is set
+// each gap is re-replicated in batches of batchSize blocks, extracted with
+// opts, retrying transient errors with policy from the last committed batch.
+func MonitorReplicationGaps(stopCtx context.Context, abortCtx context.Context, pgConn *sql.DB, sdbConn *sql.DB, interval time.Duration, heal bool, batchSize int, policy RetryPolicy, opts ExtractOptions) {
+	for {
+		gaps, err := CheckReplicationGaps(stopCtx, sdbConn)
+		if err != nil {
+			log.Printf("failed to check for replication gaps: %+v", err)
+		}
+
+		if heal {
+			for _, gap := range gaps {
+				log.Printf("filling gap from %s to %s", gap.StartHeight, gap.EndHeight)
+				next := gap.StartHeight
+				var done bool
+				err := Retry(stopCtx, policy, "heal gap", func() error {
+					var err error
+					next, done, err = ReplicateRange(stopCtx, abortCtx, pgConn, sdbConn, next, gap.EndHeight, batchSize, opts)
+					return err
+				})
+				if err != nil {
+					log.Printf("failed to fill gap from %s to %s at height %s: %+v", gap.StartHeight, gap.EndHeight, next, err)
+					break
+				}
+				if !done {
+					break
+				}
+			}
+		}
+
+		if interval <= 0 {
+			return
+		}
+		select {
+		case <-stopCtx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metaDB returns a fake SingleStore whose replication_meta has ranges, in
+// the order the query returns them.
+func metaDB(t *testing.T, ranges ...[2]string) (*sql.DB, *fakeDB) {
+	var rows [][]string
+	for _, r := range ranges {
+		rows = append(rows, []string{r[0], r[1]})
+	}
+	return openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+		if strings.Contains(query, gapQuery) {
+			return []string{"start_height", "block_height"}, rows, nil
+		}
+		return nil, nil, nil
+	})
+}
+
+const gapQuery = "SELECT COALESCE(start_height, 0), block_height FROM replication_meta"
+
+func TestFindReplicationGaps(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges [][2]string
+		want   []string
+	}{
+		{"empty", nil, nil},
+		{"adjacent", [][2]string{{"1", "10"}, {"11", "20"}, {"21", "30"}}, nil},
+		{"overlapping", [][2]string{{"0", "10"}, {"5", "20"}, {"15", "18"}, {"25", "30"}}, []string{"21-24"}},
+		// a range within an earlier one does not hide the gap after it
+		{"nested", [][2]string{{"0", "100"}, {"10", "20"}, {"30", "40"}, {"102", "110"}}, []string{"101-101"}},
+		// replication started above the first block
+		{"leading gap", [][2]string{{"100", "110"}, {"111", "120"}, {"130", "140"}}, []string{"121-129"}},
+		// rows written before start_height was recorded cover every block
+		// below them
+		{"without start heights", [][2]string{{"0", "50"}, {"0", "60"}, {"70", "80"}}, []string{"61-69"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sdbConn, _ := metaDB(t, tt.ranges...)
+			gaps, err := FindReplicationGaps(context.Background(), sdbConn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, gap := range gaps {
+				got = append(got, fmt.Sprintf("%s-%s", gap.StartHeight, gap.EndHeight))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("gaps = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMonitorReplicationGapsHealsOnceAtStartup(t *testing.T) {
+	pgConn, _ := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+		switch {
+		case query == "select pg_export_snapshot()":
+			return []string{"pg_export_snapshot"}, [][]string{{"00000003-1"}}, nil
+		case strings.HasPrefix(query, "SELECT coalesce(MAX(block_height), 0) FROM blocks"):
+			return []string{"coalesce"}, [][]string{{"100"}}, nil
+		case strings.HasPrefix(query, "select count(*) from blocks"):
+			// the chain skipped the heights of the gap
+			return []string{"count"}, [][]string{{"0"}}, nil
+		}
+		return nil, nil, nil
+	})
+	sdbConn, sdb := metaDB(t, [2]string{"1", "10"}, [2]string{"21", "30"})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		MonitorReplicationGaps(context.Background(), context.Background(), pgConn, sdbConn, 0, true, 10, RetryPolicy{}, ExtractOptions{SkipChainCheck: true})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("MonitorReplicationGaps did not return with an interval of 0")
+	}
+
+	var checks, healed int
+	for _, stmt := range sdb.Statements() {
+		if strings.HasPrefix(stmt, gapQuery) {
+			checks++
+		}
+		if strings.HasPrefix(stmt, "REPLACE INTO replication_meta") {
+			healed++
+		}
+	}
+	if checks != 1 || healed != 1 {
+		t.Errorf("checked for gaps %d times and healed %d, want once each", checks, healed)
+	}
+}
@@ -0,0 +1,289 @@
+package src
+
+import (
+	"context"
+	"log"
+	"math/big"
+	"sort"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// RootTable is read first for every batch, by block height. Every other table
+// is read based on the keys of its Source.Parent, or on the block heights of
+// the batch if it has no parent.
+const RootTable = "blocks"
+
+// TableGraph is the set of tables read for every batch, arranged by the
+// tables they depend on.
+type TableGraph struct {
+	// models contains every table other than the root, with each table
+	// after its parent
+	models   []ModelInfo
+	children map[string][]string
+
+	// loaded contains the tables which are loaded into SingleStore. Every
+	// other table in the graph is only read for the keys of its children.
+	loaded map[string]bool
+}
+
+// DefaultTableGraph contains every table in Models.
+var DefaultTableGraph *TableGraph
+
+// NewTableGraph checks that the sources of models form a tree below
+// RootTable and returns them in dependency order.
+func NewTableGraph(models []ModelInfo) (*TableGraph, error) {
+	byTable := make(map[string]ModelInfo)
+	for _, model := range models {
+		byTable[model.Table] = model
+	}
+
+	root, ok := byTable[RootTable]
+	if !ok {
+		return nil, errors.Errorf("table graph must contain %s", RootTable)
+	}
+	if root.Source != (Source{}) {
+		return nil, errors.Errorf("%s is read by block height and can not have a source", RootTable)
+	}
+
+	// depth is the number of tables between each table and the root
+	depth := make(map[string]int)
+	var visit func(table string, path []string) (int, error)
+	visit = func(table string, path []string) (int, error) {
+		if d, ok := depth[table]; ok {
+			return d, nil
+		}
+		for _, t := range path {
+			if t == table {
+				return 0, errors.Errorf("tables depend on each other: %v", append(path, table))
+			}
+		}
+
+		model := byTable[table]
+		if model.Source.Query == "" {
+			return 0, errors.Errorf("table %s has no source query", table)
+		}
+		d := 1
+		if parent := model.Source.Parent; parent != "" {
+			if _, ok := byTable[parent]; !ok {
+				return 0, errors.Errorf("table %s depends on %s which is not replicated", table, parent)
+			}
+			if parent != RootTable {
+				parentDepth, err := visit(parent, append(path, table))
+				if err != nil {
+					return 0, err
+				}
+				d = parentDepth + 1
+			}
+		}
+		depth[table] = d
+		return d, nil
+	}
+
+	g := &TableGraph{
+		children: make(map[string][]string),
+		loaded:   map[string]bool{RootTable: true},
+	}
+	for _, model := range models {
+		if model.Table == RootTable {
+			continue
+		}
+		g.loaded[model.Table] = true
+		_, err := visit(model.Table, nil)
+		if err != nil {
+			return nil, err
+		}
+		g.models = append(g.models, model)
+		if model.Source.Parent != "" {
+			g.children[model.Source.Parent] = append(g.children[model.Source.Parent], model.Table)
+		}
+	}
+
+	sort.SliceStable(g.models, func(i, j int) bool {
+		return depth[g.models[i].Table] < depth[g.models[j].Table]
+	})
+	return g, nil
+}
+
+// Loads reports whether rows from table are loaded into SingleStore.
+func (g *TableGraph) Loads(table string) bool {
+	return g.loaded[table]
+}
+
+// LoadsWithParents reports whether rows from table and from every table it is
+// found through are loaded into SingleStore, so rows of table can be matched
+// to blocks by joining through its parents in SingleStore.
+func (g *TableGraph) LoadsWithParents(table string) bool {
+	parents := make(map[string]string)
+	for _, model := range g.models {
+		parents[model.Table] = model.Source.Parent
+	}
+	for t := table; t != ""; t = parents[t] {
+		if !g.loaded[t] {
+			return false
+		}
+	}
+	return true
+}
+
+// Select returns a graph which only loads the tables loaded by g which are
+// in include, or all of them if include is empty, and are not in exclude.
+// Tables which are not loaded are still read from Postgres when a loaded
+// table depends on them.
+func (g *TableGraph) Select(include []string, exclude []string) (*TableGraph, error) {
+	known := make(map[string]ModelInfo)
+	for _, model := range g.models {
+		known[model.Table] = model
+	}
+	for _, table := range append(append([]string{}, include...), exclude...) {
+		if !g.loaded[table] {
+			return nil, errors.Errorf("table %s is not replicated", table)
+		}
+	}
+
+	loaded := make(map[string]bool)
+	if len(include) == 0 {
+		for table := range g.loaded {
+			loaded[table] = true
+		}
+	}
+	for _, table := range include {
+		loaded[table] = true
+	}
+	for _, table := range exclude {
+		delete(loaded, table)
+	}
+
+	// keep the parents of every loaded table so they can provide keys
+	needed := make(map[string]bool)
+	for table := range loaded {
+		for t := table; t != "" && !needed[t]; t = known[t].Source.Parent {
+			needed[t] = true
+		}
+	}
+
+	out := &TableGraph{
+		children: make(map[string][]string),
+		loaded:   loaded,
+	}
+	for _, model := range g.models {
+		if !needed[model.Table] {
+			continue
+		}
+		out.models = append(out.models, model)
+		if model.Source.Parent != "" {
+			out.children[model.Source.Parent] = append(out.children[model.Source.Parent], model.Table)
+		}
+	}
+	return out, nil
+}
+
+// extractTable reads the rows returned by query, writing them to the loader
+// if load is set and returning their keys if collectKeys is set. Rows which
+// do not match accounts are skipped, unless accounts is nil.
+func extractTable(ctx context.Context, db querier, loader *Loader, model ModelInfo, load bool, collectKeys bool, accounts *AccountFilter, query string, args ...interface{}) ([]string, error) {
+	if load {
+		err := loader.Touch(model.Table)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scanner, err := newRowScanner(rows)
+	if err != nil {
+		return nil, err
+	}
+	dst := model.New()
+	keys := make([]string, 0)
+	for rows.Next() {
+		err := scanner.Scan(dst)
+		if err != nil {
+			return nil, err
+		}
+		if accounts != nil && !accounts.Includes(dst) {
+			continue
+		}
+		if collectKeys {
+			keys = append(keys, dst.Key())
+		}
+		if !load {
+			continue
+		}
+		err = loader.WriteRow(model.Table, dst)
+		if err != nil {
+			return nil, err
+		}
+		MetricReplicatedRows.Inc()
+	}
+	return keys, rows.Err()
+}
+
+// extract reads every table in the graph for a batch whose root rows have
+// rootKeys. Each table is read in its own transaction joined to snapshot as
+// soon as its parent has been read. Tables without a parent are read from
+// the rows updated between startHeight and endHeight. If accounts is set,
+// rows which belong to other accounts are skipped along with their children.
+func (g *TableGraph) extract(ctx context.Context, snapshot *pgSnapshot, loader *Loader, rootKeys []string, startHeight *big.Int, endHeight string, accounts *AccountFilter) error {
+	type result struct {
+		done chan struct{}
+		keys []string
+		err  error
+
+		// skipped is set if the table was not read because its parent
+		// failed
+		skipped bool
+	}
+
+	results := make(map[string]*result, len(g.models)+1)
+	results[RootTable] = &result{done: make(chan struct{}), keys: rootKeys}
+	close(results[RootTable].done)
+	for _, model := range g.models {
+		results[model.Table] = &result{done: make(chan struct{})}
+	}
+
+	for _, model := range g.models {
+		model := model
+		res := results[model.Table]
+		go func() {
+			defer close(res.done)
+
+			args := []interface{}{startHeight.String(), endHeight}
+			if parent := model.Source.Parent; parent != "" {
+				parentRes := results[parent]
+				<-parentRes.done
+				if parentRes.err != nil || parentRes.skipped {
+					res.skipped = true
+					return
+				}
+				args = []interface{}{pq.Array(parentRes.keys)}
+			}
+
+			tx, err := snapshot.Join(ctx)
+			if err != nil {
+				res.err = err
+				return
+			}
+			defer tx.Rollback()
+
+			res.keys, res.err = extractTable(ctx, tx, loader, model, g.loaded[model.Table], len(g.children[model.Table]) > 0, accounts, model.Source.Query, args...)
+		}()
+	}
+
+	var lastError error
+	for _, model := range g.models {
+		res := results[model.Table]
+		<-res.done
+		if res.err != nil {
+			lastError = errors.Wrapf(res.err, "failed to replicate %s", model.Table)
+			log.Printf("error while loading into SingleStore: %+v", lastError)
+		}
+	}
+	return lastError
+}
@@ -0,0 +1,226 @@
+package src
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func testModel(table, parent string) ModelInfo {
+	m := ModelInfo{Table: table}
+	if table != RootTable {
+		m.Source = Source{Parent: parent, Query: "select * from " + table}
+	}
+	return m
+}
+
+func graphTables(g *TableGraph) []string {
+	out := make([]string, 0, len(g.models))
+	for _, m := range g.models {
+		out = append(out, m.Table)
+	}
+	return out
+}
+
+func loadedTables(g *TableGraph) []string {
+	out := make([]string, 0, len(g.loaded))
+	for table := range g.loaded {
+		out = append(out, table)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestNewTableGraph(t *testing.T) {
+	tests := []struct {
+		name   string
+		models []ModelInfo
+		err    string
+		order  []string
+	}{
+		{
+			name:   "children after parents",
+			models: []ModelInfo{testModel("c", "b"), testModel("b", RootTable), testModel(RootTable, ""), testModel("a", "")},
+			order:  []string{"b", "a", "c"},
+		},
+		{
+			name:   "no root",
+			models: []ModelInfo{testModel("a", "")},
+			err:    "must contain blocks",
+		},
+		{
+			name:   "root with a source",
+			models: []ModelInfo{{Table: RootTable, Source: Source{Query: "select 1"}}},
+			err:    "can not have a source",
+		},
+		{
+			name:   "unknown parent",
+			models: []ModelInfo{testModel(RootTable, ""), testModel("a", "missing")},
+			err:    "depends on missing which is not replicated",
+		},
+		{
+			name:   "cycle",
+			models: []ModelInfo{testModel(RootTable, ""), testModel("a", "b"), testModel("b", "a")},
+			err:    "depend on each other",
+		},
+		{
+			name:   "no query",
+			models: []ModelInfo{testModel(RootTable, ""), {Table: "a", Source: Source{Parent: RootTable}}},
+			err:    "has no source query",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := NewTableGraph(tt.models)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := graphTables(g); !reflect.DeepEqual(got, tt.order) {
+				t.Errorf("order = %v, want %v", got, tt.order)
+			}
+		})
+	}
+}
+
+func TestDefaultTableGraphLoadsEveryModel(t *testing.T) {
+	for _, m := range Models {
+		if !DefaultTableGraph.Loads(m.Table) {
+			t.Errorf("%s is not loaded", m.Table)
+		}
+	}
+}
+
+func TestTableGraphSelect(t *testing.T) {
+	g, err := NewTableGraph([]ModelInfo{
+		testModel(RootTable, ""),
+		testModel("receipts", RootTable),
+		testModel("action_receipts", "receipts"),
+		testModel("transactions", RootTable),
+		testModel("transaction_actions", "transactions"),
+		testModel("accounts", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		err     string
+		loaded  []string
+		read    []string
+	}{
+		{
+			name:   "everything",
+			loaded: []string{"accounts", "action_receipts", RootTable, "receipts", "transaction_actions", "transactions"},
+			read:   []string{"receipts", "transactions", "accounts", "action_receipts", "transaction_actions"},
+		},
+		{
+			name:    "child keeps its parents as sources",
+			include: []string{"action_receipts"},
+			loaded:  []string{"action_receipts"},
+			read:    []string{"receipts", "action_receipts"},
+		},
+		{
+			name:    "exclude a parent",
+			exclude: []string{"transactions"},
+			loaded:  []string{"accounts", "action_receipts", RootTable, "receipts", "transaction_actions"},
+			read:    []string{"receipts", "transactions", "accounts", "action_receipts", "transaction_actions"},
+		},
+		{
+			name:    "exclude a subtree",
+			exclude: []string{"transactions", "transaction_actions"},
+			loaded:  []string{"accounts", "action_receipts", RootTable, "receipts"},
+			read:    []string{"receipts", "accounts", "action_receipts"},
+		},
+		{
+			name:    "include and exclude",
+			include: []string{RootTable, "accounts"},
+			exclude: []string{"accounts"},
+			loaded:  []string{RootTable},
+			read:    []string{},
+		},
+		{
+			name:    "unknown table",
+			include: []string{"chunks"},
+			err:     "table chunks is not replicated",
+		},
+		{
+			name:    "unknown excluded table",
+			exclude: []string{"chunks"},
+			err:     "table chunks is not replicated",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel, err := g.Select(tt.include, tt.exclude)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := loadedTables(sel); !reflect.DeepEqual(got, tt.loaded) {
+				t.Errorf("loaded = %v, want %v", got, tt.loaded)
+			}
+			if got := graphTables(sel); !reflect.DeepEqual(got, tt.read) {
+				t.Errorf("read = %v, want %v", got, tt.read)
+			}
+		})
+	}
+
+	// selecting from a selection can not load tables which were dropped
+	sel, err := g.Select(nil, []string{"accounts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sel.Select([]string{"accounts"}, nil); err == nil {
+		t.Error("expected an error selecting a table which is not loaded")
+	}
+}
+
+func TestTableGraphLoadsWithParents(t *testing.T) {
+	g, err := NewTableGraph([]ModelInfo{
+		testModel(RootTable, ""),
+		testModel("receipts", RootTable),
+		testModel("action_receipts", "receipts"),
+		testModel("accounts", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sel, err := g.Select(nil, []string{"receipts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		graph *TableGraph
+		table string
+		want  bool
+	}{
+		{g, "action_receipts", true},
+		{g, "accounts", true},
+		{g, "chunks", false},
+		{sel, "action_receipts", false},
+		{sel, "receipts", false},
+		{sel, "accounts", true},
+		{sel, RootTable, true},
+	}
+	for _, tt := range tests {
+		if got := tt.graph.LoadsWithParents(tt.table); got != tt.want {
+			t.Errorf("LoadsWithParents(%s) = %v, want %v", tt.table, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,604 @@
+package src
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// copyProgressRows is how often the progress of copying a chunk is logged
+const copyProgressRows = 1000000
+
+// ErrAlreadyLoaded is returned when starting an initial load into a
+// SingleStore database which already contains replicated blocks.
+var ErrAlreadyLoaded = errors.New("singlestore already contains replicated blocks")
+
+// InitialLoad copies whole tables from Postgres into SingleStore, replacing
+// their contents, to populate SingleStore before replication starts. Every
+// table is split into chunks of block heights which are loaded in their own
+// transactions and recorded in init_load_progress, so an interrupted load
+// resumes with the chunks it had not finished.
+type InitialLoad struct {
+	// Tables is the graph of replicated tables, or nil for every table.
+	// Only loaded tables are copied.
+	Tables *TableGraph
+
+	// ChunkSize is the number of block heights per chunk
+	ChunkSize int64
+
+	// Workers is the number of chunks copied concurrently
+	Workers int
+
+	// Replace allows a new load to start when SingleStore already contains
+	// replicated blocks
+	Replace bool
+}
+
+// copiedWhole lists the tables which are copied in a single chunk rather than
+// by block heights. Their rows are updated in place and keep the height of
+// their last update, which can be outside the blocks in Postgres, such as the
+// accounts created at genesis when Postgres starts at a later block.
+var copiedWhole = map[string]bool{
+	"access_keys": true,
+	"accounts":    true,
+}
+
+// initLoadChunk is the rows of one table which belong to a range of blocks,
+// or every row of a table in copiedWhole
+type initLoadChunk struct {
+	model   ModelInfo
+	heights heightRange
+}
+
+// initLoadProgress is an initial load recorded in init_load_progress. The
+// load is marked as started by a row without a table_name, which holds the
+// range of blocks being loaded, and every completed chunk has a row of its
+// own.
+type initLoadProgress struct {
+	// heights is the range of blocks being loaded, or nil if no load has
+	// been started
+	heights *heightRange
+
+	// completed contains the table, start and end height of every completed
+	// chunk joined by colons
+	completed map[string]bool
+}
+
+func readInitLoadProgress(ctx context.Context, sdbConn *sql.DB) (*initLoadProgress, error) {
+	rows, err := sdbConn.QueryContext(ctx, "SELECT table_name, start_height, end_height FROM init_load_progress")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read initial load progress")
+	}
+	defer rows.Close()
+
+	out := &initLoadProgress{completed: make(map[string]bool)}
+	for rows.Next() {
+		var table, start, end string
+		err = rows.Scan(&table, &start, &end)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan initial load progress")
+		}
+		if table == "" {
+			out.heights = &heightRange{start: ParseBigInt(start), end: ParseBigInt(end)}
+			continue
+		}
+		out.completed[table+":"+start+":"+end] = true
+	}
+	return out, rows.Err()
+}
+
+// tableStarted reports whether a chunk of table has been completed.
+func (p *initLoadProgress) tableStarted(table string) bool {
+	for key := range p.completed {
+		if strings.HasPrefix(key, table+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkInitLoadChunks returns an error unless all of the completed chunks of
+// the loaded tables are among the chunks of this run, of which matched were
+// found to be completed. Loading the rows of a completed chunk again in a
+// chunk of another size would fail on their keys.
+func checkInitLoadChunks(loaded []ModelInfo, completed map[string]bool, matched int) error {
+	n := 0
+	for _, model := range loaded {
+		for key := range completed {
+			if strings.HasPrefix(key, model.Table+":") {
+				n++
+			}
+		}
+	}
+	if n != matched {
+		return errors.Errorf("%d chunks were completed with a different --chunk-size; resume the load with the chunk size it was started with", n-matched)
+	}
+	return nil
+}
+
+// Run copies every chunk which has not been completed yet from a single
+// Postgres snapshot. The range of blocks to load is taken from the snapshot
+// of the run which started the load, so a resumed load copies the same
+// chunks. Once every chunk is complete, the blocks up to the end of the
+// range are recorded as replicated so that replication continues from the
+// next block, and the progress is cleared.
+// Workers stop picking up new chunks once stopCtx is cancelled; cancelling
+// abortCtx rolls back the chunks currently being copied.
+func (l *InitialLoad) Run(stopCtx context.Context, abortCtx context.Context, pgConfig ConnectionConfig, pgConn *sql.DB, sdbConn *sql.DB) error {
+	if l.ChunkSize < 1 || l.Workers < 1 {
+		return errors.New("chunk size and workers must be positive")
+	}
+	tables := l.Tables
+	if tables == nil {
+		tables = DefaultTableGraph
+	}
+
+	loaded := make([]ModelInfo, 0, len(Models))
+	for _, model := range Models {
+		if tables.Loads(model.Table) {
+			loaded = append(loaded, model)
+		}
+	}
+
+	progress, err := readInitLoadProgress(abortCtx, sdbConn)
+	if err != nil {
+		return err
+	}
+	if progress.heights == nil && !l.Replace {
+		replicated, err := ReadMaxReplicatedBlockHeight(sdbConn)
+		if err != nil {
+			return err
+		}
+		if replicated.Sign() > 0 {
+			return ErrAlreadyLoaded
+		}
+	}
+
+	snapshot, err := beginSnapshot(abortCtx, pgConn)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	heights := progress.heights
+	if heights == nil {
+		// starting a new load rather than resuming one. The load is marked
+		// as started along with its range before anything is removed, so
+		// that a load interrupted before its first chunk is resumed rather
+		// than refused.
+		var minHeight string
+		err = snapshot.tx.QueryRowContext(abortCtx, "select coalesce(min(block_height), 0) from blocks").Scan(&minHeight)
+		if err != nil {
+			return errors.Wrap(err, "failed to query first block")
+		}
+		maxHeight, err := ReadMaxBlockHeight(snapshot.tx)
+		if err != nil {
+			return err
+		}
+		heights = &heightRange{start: ParseBigInt(minHeight), end: maxHeight}
+
+		_, err = sdbConn.ExecContext(abortCtx, "REPLACE INTO init_load_progress (table_name, start_height, end_height, completed_at) VALUES ('', ?, ?, NOW())",
+			heights.start.String(), heights.end.String())
+		if err != nil {
+			return errors.Wrap(err, "failed to save initial load progress")
+		}
+	}
+	completed := progress.completed
+	if len(completed) == 0 {
+		_, err = sdbConn.ExecContext(abortCtx, "DELETE FROM replication_meta")
+		if err != nil {
+			return errors.Wrap(err, "failed to clear replication_meta")
+		}
+	}
+
+	ranges := splitHeights(heights.start, heights.end, l.ChunkSize)
+	whole := []heightRange{*heights}
+	pending := make([]initLoadChunk, 0, len(loaded)*len(ranges))
+	total := 0
+	for _, model := range loaded {
+		chunks := ranges
+		if copiedWhole[model.Table] {
+			chunks = whole
+		}
+		total += len(chunks)
+		for _, r := range chunks {
+			if !completed[model.Table+":"+r.start.String()+":"+r.end.String()] {
+				pending = append(pending, initLoadChunk{model: model, heights: r})
+			}
+		}
+	}
+	err = checkInitLoadChunks(loaded, completed, total-len(pending))
+	if err != nil {
+		return err
+	}
+
+	// rows are loaded without REPLACE, so every table without a completed
+	// chunk is emptied, both when a load starts and for tables added to a
+	// resumed load
+	for _, model := range loaded {
+		if progress.tableStarted(model.Table) {
+			continue
+		}
+		_, err = sdbConn.ExecContext(abortCtx, "TRUNCATE TABLE "+model.Table)
+		if err != nil {
+			return errors.Wrapf(err, "failed to truncate %s", model.Table)
+		}
+	}
+	log.Printf("initial load of blocks %s to %s: %d chunks remaining (%d already completed)",
+		heights.start, heights.end, len(pending), total-len(pending))
+	MetricInitLoadChunksRemaining.Set(float64(len(pending)))
+
+	ctx, cancel := context.WithCancel(abortCtx)
+	defer cancel()
+
+	work := make(chan initLoadChunk)
+	errs := make(chan error, l.Workers)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < l.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := copyChunks(ctx, pgConfig, snapshot.id, sdbConn, work)
+			if err != nil {
+				errs <- err
+				cancel()
+			}
+		}()
+	}
+
+	stopped := false
+outer:
+	for _, chunk := range pending {
+		select {
+		case work <- chunk:
+		case <-stopCtx.Done():
+			stopped = true
+			break outer
+		case <-ctx.Done():
+			break outer
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if abortCtx.Err() != nil {
+		log.Printf("aborted the initial load; run it again to resume")
+		return nil
+	}
+	select {
+	case err = <-errs:
+		return err
+	default:
+	}
+	if stopped {
+		log.Printf("stopped before the initial load finished; run it again to resume")
+		return nil
+	}
+
+	tx, err := sdbConn.BeginTx(abortCtx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	err = WriteReplicatedRange(tx, big.NewInt(0), heights.end)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(abortCtx, "DELETE FROM init_load_progress")
+	if err != nil {
+		return errors.Wrap(err, "failed to clear initial load progress")
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit initial load")
+	}
+
+	for _, model := range loaded {
+		_, err = sdbConn.ExecContext(abortCtx, "ANALYZE TABLE "+model.Table)
+		if err != nil {
+			return errors.Wrapf(err, "failed to analyze %s", model.Table)
+		}
+	}
+
+	log.Printf("initial load finished; replication will continue after block height %s", heights.end)
+	return nil
+}
+
+// copyColumns returns the fields of model which are read from Postgres along
+// with their columns.
+func copyColumns(model ModelInfo) ([]string, []string) {
+	skip := make(map[string]bool)
+	for _, column := range replicationOnlyColumns[model.Table] {
+		skip[column] = true
+	}
+
+	fields := make([]string, 0, model.Type.NumField())
+	columns := make([]string, 0, model.Type.NumField())
+	for i := 0; i < model.Type.NumField(); i++ {
+		field := model.Type.Field(i).Name
+		column := model.FieldMap[field]
+		if skip[column] {
+			continue
+		}
+		fields = append(fields, field)
+		columns = append(columns, column)
+	}
+	return fields, columns
+}
+
+// inlineHeights replaces the pairs of ? placeholders in a range condition with
+// the bounds of r, since COPY does not take query arguments.
+func inlineHeights(condition string, r heightRange) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range condition {
+		if c != '?' {
+			b.WriteRune(c)
+			continue
+		}
+		if n%2 == 0 {
+			b.WriteString(r.start.String())
+		} else {
+			b.WriteString(r.end.String())
+		}
+		n++
+	}
+	return b.String()
+}
+
+// copyQuery returns the fields of the model of the chunk which are copied, in
+// order, along with the COPY query which selects them for the rows of the
+// chunk.
+func (c initLoadChunk) copyQuery() ([]string, string) {
+	fields, columns := copyColumns(c.model)
+	quoted := make([]string, 0, len(columns))
+	for _, column := range columns {
+		quoted = append(quoted, pq.QuoteIdentifier(column))
+	}
+	condition := inlineHeights(rangeConditions[c.model.Table], c.heights)
+	if copiedWhole[c.model.Table] {
+		condition = "true"
+	}
+	return fields, fmt.Sprintf("copy (select %s from %s where %s) to stdout",
+		strings.Join(quoted, ", "), c.model.Table, condition)
+}
+
+// copyChunks copies the chunks received from work over one Postgres
+// connection which reads from the snapshot.
+func copyChunks(ctx context.Context, pgConfig ConnectionConfig, snapshotID string, sdbConn *sql.DB, work <-chan initLoadChunk) error {
+	conn, err := ConnectPostgresConn(ctx, pgConfig)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to postgres")
+	}
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, "begin isolation level repeatable read read only; set transaction snapshot "+pq.QuoteLiteral(snapshotID)).ReadAll()
+	if err != nil {
+		return errors.Wrapf(err, "failed to import snapshot %s", snapshotID)
+	}
+
+	for chunk := range work {
+		err = copyChunk(ctx, conn, sdbConn, chunk)
+		if err != nil {
+			return errors.Wrapf(err, "failed to copy %s for blocks %s to %s", chunk.model.Table, chunk.heights.start, chunk.heights.end)
+		}
+		MetricInitLoadChunksRemaining.Dec()
+	}
+	return nil
+}
+
+// copyChunk loads the rows of a chunk into SingleStore and records the chunk
+// in init_load_progress within one transaction. The rows are streamed from
+// COPY TO STDOUT straight into LOAD DATA without being buffered.
+func copyChunk(ctx context.Context, conn *pgconn.PgConn, sdbConn *sql.DB, chunk initLoadChunk) error {
+	start := time.Now()
+	model := chunk.model
+
+	tx, err := sdbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	fields, copyQuery := chunk.copyQuery()
+
+	copyR, copyW := io.Pipe()
+	copyDone := make(chan error, 1)
+	go func() {
+		_, err := conn.CopyTo(ctx, copyW, copyQuery)
+		copyW.CloseWithError(err)
+		copyDone <- err
+	}()
+
+	loadR, loadW := io.Pipe()
+	buffered := bufio.NewWriterSize(loadW, 1<<20)
+	// the tables were truncated before the load, so rows are loaded without
+	// REPLACE: a replaced row counts twice in the rows affected, which
+	// could hide rows which were skipped
+	stream := newStream(model, buffered, false)
+	var loadResult sql.Result
+	loadDone := make(chan error, 1)
+	go func() {
+		var err error
+		loadResult, err = stream.loadFrom(ctx, tx, loadR)
+		// unblock the writer if LOAD DATA stops reading early
+		loadR.CloseWithError(err)
+		loadDone <- err
+	}()
+
+	err = copyRows(bufio.NewReaderSize(copyR, 1<<20), stream, model, fields)
+	if err == nil {
+		err = errors.Wrap(buffered.Flush(), "failed to load into singlestore")
+	}
+	if err != nil {
+		copyR.CloseWithError(err)
+		loadW.CloseWithError(err)
+	} else {
+		loadW.Close()
+	}
+	loadErr := <-loadDone
+	copyErr := <-copyDone
+	if err != nil {
+		return err
+	}
+	if copyErr != nil {
+		return errors.Wrap(copyErr, "failed to copy from postgres")
+	}
+	if loadErr != nil {
+		return errors.Wrap(loadErr, "failed to load into singlestore")
+	}
+
+	loaded, err := loadResult.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if loaded != int64(stream.rows) {
+		return errors.Errorf("postgres has %d rows in %s for blocks %s to %s but only %d were loaded; see information_schema.LOAD_DATA_ERRORS for handle %s",
+			stream.rows, model.Table, chunk.heights.start, chunk.heights.end, loaded, model.Table)
+	}
+
+	_, err = tx.ExecContext(ctx, "REPLACE INTO init_load_progress (table_name, start_height, end_height, completed_at) VALUES (?, ?, ?, NOW())",
+		model.Table, chunk.heights.start.String(), chunk.heights.end.String())
+	if err != nil {
+		return errors.Wrap(err, "failed to save initial load progress")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit chunk")
+	}
+
+	log.Printf("copied %d rows into %s for blocks %s to %s in %s", stream.rows, model.Table, chunk.heights.start, chunk.heights.end, time.Since(start))
+	return nil
+}
+
+// copyRows decodes the output of COPY TO STDOUT in the text format, with one
+// column per field, and writes every row to stream.
+func copyRows(r *bufio.Reader, stream *Stream, model ModelInfo, fields []string) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err == io.EOF {
+			return errors.New("copy output ended in the middle of a row")
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read from postgres")
+		}
+
+		values := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+		if len(values) != len(fields) {
+			return errors.Errorf("expected %d columns from postgres but got %d", len(fields), len(values))
+		}
+
+		row := model.New()
+		v := reflect.ValueOf(row).Elem()
+		for i, value := range values {
+			field := v.FieldByName(fields[i])
+			if value == `\N` {
+				if field.Kind() != reflect.Ptr {
+					return errors.Errorf("column %s is unexpectedly null", model.FieldMap[fields[i]])
+				}
+				continue
+			}
+			err = setField(field, unescapeCopyText(value))
+			if err != nil {
+				return errors.Wrapf(err, "failed to read column %s", model.FieldMap[fields[i]])
+			}
+		}
+		if block, ok := row.(*Block); ok {
+			block.Finalized = true
+		}
+
+		err = stream.WriteRow(row)
+		if err != nil {
+			return errors.Wrap(err, "failed to load into singlestore")
+		}
+		if stream.rows%copyProgressRows == 0 {
+			log.Printf("copied %d rows of %s so far", stream.rows, model.Table)
+		}
+	}
+}
+
+// unescapeCopyText decodes a column in the text format of COPY, which escapes
+// backslashes, tabs, newlines and other control characters with a backslash.
+func unescapeCopyText(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+
+		i++
+		c = s[i]
+		switch {
+		case c == 'b':
+			b.WriteByte('\b')
+		case c == 'f':
+			b.WriteByte('\f')
+		case c == 'n':
+			b.WriteByte('\n')
+		case c == 'r':
+			b.WriteByte('\r')
+		case c == 't':
+			b.WriteByte('\t')
+		case c == 'v':
+			b.WriteByte('\v')
+		case c >= '0' && c <= '7':
+			// up to three octal digits
+			n := c - '0'
+			for j := 0; j < 2 && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '7'; j++ {
+				i++
+				n = n*8 + s[i] - '0'
+			}
+			b.WriteByte(n)
+		case c == 'x' && i+1 < len(s) && isHexDigit(s[i+1]):
+			// up to two hex digits
+			var n byte
+			for j := 0; j < 2 && i+1 < len(s) && isHexDigit(s[i+1]); j++ {
+				i++
+				n = n*16 + hexValue(s[i])
+			}
+			b.WriteByte(n)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexValue(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	default:
+		return c - '0'
+	}
+}
@@ -0,0 +1,137 @@
+package src
+
+import (
+	"context"
+	"database/sql/driver"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestUnescapeCopyText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"plain text", "plain text"},
+		{`a\\b`, `a\b`},
+		{`tab\there`, "tab\there"},
+		{`line\nbreak\r`, "line\nbreak\r"},
+		{`\b\f\v`, "\b\f\v"},
+		// a literal \N string is escaped, unlike a NULL column
+		{`\\N`, `\N`},
+		{`\101\1010`, "AA0"},
+		{`\0`, "\x00"},
+		{`\7a`, "\x07a"},
+		{`\x41\x4a\x4Ag`, "AJJg"},
+		{`\x4`, "\x04"},
+		{`\xz`, "xz"},
+		{`\q`, "q"},
+		{`trailing\`, `trailing\`},
+		{"café", "café"},
+	}
+	for _, tt := range tests {
+		if got := unescapeCopyText(tt.in); got != tt.want {
+			t.Errorf("unescapeCopyText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestInlineHeights(t *testing.T) {
+	r := heightRange{start: big.NewInt(100), end: big.NewInt(199)}
+	tests := []struct {
+		in, want string
+	}{
+		{"block_height between ? and ?", "block_height between 100 and 199"},
+		{"a between ? and ? or b between ? and ?", "a between 100 and 199 or b between 100 and 199"},
+		{"true", "true"},
+	}
+	for _, tt := range tests {
+		if got := inlineHeights(tt.in, r); got != tt.want {
+			t.Errorf("inlineHeights(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	// every range condition must bind both bounds of the range
+	for table, condition := range rangeConditions {
+		got := inlineHeights(condition, r)
+		if strings.Contains(got, "?") {
+			t.Errorf("range condition of %s still has placeholders: %s", table, got)
+		}
+		if strings.Count(condition, "?")%2 != 0 {
+			t.Errorf("range condition of %s has an odd number of placeholders", table)
+		}
+	}
+}
+
+func TestChunkCopyQuery(t *testing.T) {
+	r := heightRange{start: big.NewInt(100), end: big.NewInt(199)}
+	for _, model := range Models {
+		_, query := initLoadChunk{model: model, heights: r}.copyQuery()
+		bounded := strings.Contains(query, "100") && strings.Contains(query, "199")
+		if copiedWhole[model.Table] {
+			if bounded || !strings.HasSuffix(query, " where true) to stdout") {
+				t.Errorf("%s is not copied whole: %s", model.Table, query)
+			}
+		} else if !bounded {
+			t.Errorf("%s is not copied by block heights: %s", model.Table, query)
+		}
+	}
+}
+
+func TestReadInitLoadProgress(t *testing.T) {
+	progressRows := [][]string{
+		{"", "100", "350"},
+		{"blocks", "100", "199"},
+		{"blocks", "200", "299"},
+		{"accounts", "100", "350"},
+	}
+	sdbConn, _ := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+		return []string{"table_name", "start_height", "end_height"}, progressRows, nil
+	})
+	progress, err := readInitLoadProgress(context.Background(), sdbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.heights == nil || progress.heights.start.Int64() != 100 || progress.heights.end.Int64() != 350 {
+		t.Errorf("heights = %v, want 100 to 350", progress.heights)
+	}
+	if len(progress.completed) != 3 || !progress.completed["blocks:200:299"] || !progress.completed["accounts:100:350"] {
+		t.Errorf("completed = %v", progress.completed)
+	}
+	if !progress.tableStarted("blocks") || progress.tableStarted("chunks") {
+		t.Errorf("started tables do not match the completed chunks %v", progress.completed)
+	}
+
+	progressRows = nil
+	progress, err = readInitLoadProgress(context.Background(), sdbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.heights != nil || len(progress.completed) != 0 {
+		t.Errorf("progress = %+v, want no load", progress)
+	}
+}
+
+func TestCheckInitLoadChunks(t *testing.T) {
+	var blocks, chunks ModelInfo
+	for _, model := range Models {
+		switch model.Table {
+		case "blocks":
+			blocks = model
+		case "chunks":
+			chunks = model
+		}
+	}
+	completed := map[string]bool{"blocks:100:199": true, "chunks:100:149": true}
+
+	// chunks are not loaded any more
+	if err := checkInitLoadChunks([]ModelInfo{blocks}, completed, 1); err != nil {
+		t.Error(err)
+	}
+	// chunks of 100 heights now
+	err := checkInitLoadChunks([]ModelInfo{blocks, chunks}, completed, 1)
+	if err == nil || !strings.Contains(err.Error(), "1 chunks were completed with a different --chunk-size") {
+		t.Errorf("got error %v", err)
+	}
+}
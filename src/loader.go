@@ -1,223 +1,168 @@
 package src
 
 import (
-	"database/sql"
-	"fmt"
-	"io"
-	"io/ioutil"
+	"context"
+	"math/big"
 	"sort"
-	"strings"
-	"sync"
-	"unicode"
 
-	"github.com/go-sql-driver/mysql"
-	"github.com/hamba/avro"
 	"github.com/pkg/errors"
-	uuid "github.com/satori/go.uuid"
-	"golang.org/x/text/runes"
-	"golang.org/x/text/transform"
 )
 
-type Stream struct {
-	touched       bool
-	table         string
-	readID        string
-	loadDataQuery string
-	w             *avro.Encoder
-	pw            io.WriteCloser
-	pr            io.Reader
-}
-
-func NewStream(model ModelInfo) *Stream {
-	pr, pw := io.Pipe()
-	w := avro.NewEncoderForSchema(model.Schema, pw)
-
-	var columnMap []string
-	for fieldName, columnName := range model.FieldMap {
-		columnMap = append(columnMap, fmt.Sprintf("%s <- %s", columnName, fieldName))
-	}
-	sort.Strings(columnMap)
-
-	readID := uuid.NewV4().String()
-	query := fmt.Sprintf(`
-		LOAD DATA LOCAL INFILE 'Reader::%s'
-		REPLACE INTO TABLE %s
-		FORMAT AVRO
-		( %s )
-		SCHEMA '%s'
-		ERRORS HANDLE '%s'
-	`, readID, model.Table, strings.Join(columnMap, ", "), model.Schema.String(), model.Table)
-
-	return &Stream{
-		table:         model.Table,
-		readID:        readID,
-		loadDataQuery: query,
-		w:             w,
-		pw:            pw,
-		pr:            pr,
-	}
-}
-
-func (s *Stream) LoadData(sdbConn *sql.DB) error {
-	mysql.RegisterReaderHandler(s.readID, func() io.Reader { return s.pr })
-	defer mysql.DeregisterReaderHandler(s.readID)
-
-	_, err := sdbConn.Exec(s.loadDataQuery)
-	return err
-}
+// Loader writes the rows of one batch to a SinkBatch, keeping track of how
+// many rows every table received and which tables were read at all.
+type Loader struct {
+	batch  SinkBatch
+	tables map[string]*loaderTable
 
-func isInBasicMultilingualPlane(r rune) bool {
-	return r <= 0xffff
+	// maxBytes fails WriteRow with a BatchTooLargeError once the batch is
+	// larger when encoded, if the batch reports its size and maxBytes is
+	// positive
+	maxBytes int64
 }
 
-// BMP represents all runes in the Basic Multilingual Plane
-// Runes above this range are not supported until SingleStore 7.5
-var BMP = &unicode.RangeTable{
-	R16: []unicode.Range16{
-		{0x0000, 0xffff, 1},
-	},
+type loaderTable struct {
+	model   ModelInfo
+	touched bool
+	rows    int
 }
 
-var NotBMP = runes.NotIn(BMP)
-
-var MapNotBMP = runes.Map(func(r rune) rune {
-	if NotBMP.Contains(r) {
-		return '�'
-	}
-	return r
-})
-
-func (s *Stream) WriteRow(row Model) error {
-	var err error
-	switch r := row.(type) {
-	case *ActionReceiptAction:
-		r.Args, _, err = transform.String(MapNotBMP, r.Args)
-		if err != nil {
-			panic(fmt.Sprintf("failed to sanitize non-bmp characters in string %q", r.Args))
-		}
-	case *TransactionAction:
-		r.Args, _, err = transform.String(MapNotBMP, r.Args)
-		if err != nil {
-			panic(fmt.Sprintf("failed to sanitize non-bmp characters in string %q", r.Args))
-		}
+// NewLoader opens a batch on sink for every table loaded by tables.
+func NewLoader(sink Sink, tables *TableGraph) (*Loader, error) {
+	batch, err := sink.Begin(tables)
+	if err != nil {
+		return nil, err
 	}
 
-	return s.w.Encode(row)
-}
-
-func (s *Stream) Touch() {
-	s.touched = true
-}
-
-func (s *Stream) Close() error {
-	return s.pw.Close()
-}
-
-type LoadErr struct {
-	table string
-	err   error
-}
-
-type Loader struct {
-	streams    map[string]*Stream
-	streamErrs chan LoadErr
-	wg         *sync.WaitGroup
-}
-
-func NewLoader(sdbConn *sql.DB) *Loader {
 	l := &Loader{
-		streams:    make(map[string]*Stream),
-		streamErrs: make(chan LoadErr),
-		wg:         &sync.WaitGroup{},
+		batch:  batch,
+		tables: make(map[string]*loaderTable),
 	}
-
 	for _, model := range Models {
-		stream := NewStream(model)
-		l.streams[model.Table] = stream
-		l.wg.Add(1)
-		go func(stream *Stream) {
-			err := stream.LoadData(sdbConn)
-			l.wg.Done()
-			if err != nil {
-				l.streamErrs <- LoadErr{table: stream.table, err: err}
-
-				// flush the stream so the writer side of the pipe doesn't deadlock
-				io.Copy(ioutil.Discard, stream.pr)
-			}
-		}(stream)
+		if tables.Loads(model.Table) {
+			l.tables[model.Table] = &loaderTable{model: model}
+		}
 	}
+	return l, nil
+}
 
-	return l
+func (l *Loader) table(name string) (*loaderTable, error) {
+	t, ok := l.tables[name]
+	if !ok {
+		return nil, errors.Errorf("no table with name %s", name)
+	}
+	return t, nil
 }
 
 func (l *Loader) Touch(table string) error {
-	s, ok := l.streams[table]
-	if !ok {
-		return errors.Errorf("no table with name %s", table)
+	t, err := l.table(table)
+	if err != nil {
+		return err
 	}
 
-	s.Touch()
+	t.touched = true
 	return nil
 }
 
 func (l *Loader) UntouchedTables() []string {
 	out := make([]string, 0)
-	for _, stream := range l.streams {
-		if !stream.touched {
-			out = append(out, stream.table)
+	for name, t := range l.tables {
+		if !t.touched {
+			out = append(out, name)
 		}
 	}
 	return out
 }
 
-func (l *Loader) WriteRow(table string, row Model) error {
-	s, ok := l.streams[table]
-	if !ok {
-		return errors.Errorf("no table with name %s", table)
-	}
+// TableStats describes the rows written to one table.
+type TableStats struct {
+	Table string
+	Rows  int
 
-	return s.WriteRow(row)
+	// Bytes is the size of the rows once encoded by the sink, or 0 if the
+	// sink does not report it
+	Bytes int64
 }
 
-func (l *Loader) Error() error {
-	errs := make([]LoadErr, 0)
-outer:
-	for {
-		select {
-		case err := <-l.streamErrs:
-			errs = append(errs, err)
-		default:
-			break outer
+// Stats returns the rows written to every table, ordered by table.
+func (l *Loader) Stats() []TableStats {
+	sizer, _ := l.batch.(encodedSizer)
+	out := make([]TableStats, 0, len(l.tables))
+	for name, t := range l.tables {
+		stats := TableStats{Table: name, Rows: t.rows}
+		if sizer != nil {
+			stats.Bytes = sizer.EncodedBytes(name)
 		}
+		out = append(out, stats)
 	}
-	if len(errs) > 0 {
-		fmt.Printf("%d loads failed\n", len(errs))
-		for i, err := range errs {
-			fmt.Printf("\t%d: table %s error %+v\n", i, err.table, err.err)
-		}
-		return errs[0].err
+	sort.Slice(out, func(i, j int) bool { return out[i].Table < out[j].Table })
+	return out
+}
+
+// Rows returns the total number of rows written to all tables.
+func (l *Loader) Rows() int {
+	total := 0
+	for _, t := range l.tables {
+		total += t.rows
 	}
-	return nil
+	return total
 }
 
-func (l *Loader) Close() error {
-	err := l.Error()
+func (l *Loader) WriteRow(table string, row Model) error {
+	t, err := l.table(table)
 	if err != nil {
 		return err
 	}
 
-	// no errors... should be safe to close all the streams which will cause the
-	// load data queries to complete (hopefully without issue)
-	for _, stream := range l.streams {
-		err := stream.Close()
-		if err != nil {
-			return err
-		}
+	err = l.batch.WriteRow(table, row)
+	if err != nil {
+		return err
+	}
+	t.rows++
+
+	if l.maxBytes > 0 && l.encodedBytes() > l.maxBytes {
+		return &BatchTooLargeError{MaxBytes: l.maxBytes}
 	}
+	return nil
+}
+
+// encodedBytes returns the size of every table once encoded by the sink, or 0
+// if the sink does not report it.
+func (l *Loader) encodedBytes() int64 {
+	sizer, ok := l.batch.(encodedSizer)
+	if !ok {
+		return 0
+	}
+	var total int64
+	for name := range l.tables {
+		total += sizer.EncodedBytes(name)
+	}
+	return total
+}
+
+// Delete queues row to be deleted from table when the batch is committed.
+// Only the fields listed in deleteKeys need to be set.
+func (l *Loader) Delete(table string, row Model) error {
+	_, err := l.table(table)
+	if err != nil {
+		return err
+	}
+
+	return l.batch.Delete(table, row)
+}
+
+// Finalize marks the blocks up to height as finalized when the batch is
+// committed.
+func (l *Loader) Finalize(height *big.Int) error {
+	return l.batch.Finalize(height)
+}
 
-	// streams are closed, now we need to wait for the loads to finish
-	l.wg.Wait()
+// Commit commits the batch to the sink, recording the replicated range of
+// blocks unless endHeight is nil.
+func (l *Loader) Commit(ctx context.Context, startHeight *big.Int, endHeight *big.Int) error {
+	return l.batch.Commit(ctx, startHeight, endHeight)
+}
 
-	// final check for errors
-	return l.Error()
+// Abort discards the batch.
+func (l *Loader) Abort() error {
+	return l.batch.Abort()
 }
@@ -1,9 +1,10 @@
 package src
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -23,7 +24,7 @@ var (
 
 	MetricBatchSize = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "singlestore_batch_size",
-		Help: "The total number of blocks per batch replicated to SingleStore",
+		Help: "The maximum number of blocks per batch replicated to SingleStore",
 	})
 
 	MetricBatchReplicationTime = promauto.NewHistogram(prometheus.HistogramOpts{
@@ -41,12 +42,78 @@ var (
 		Name: "singlestore_replication_lag",
 		Help: "How many blocks singlestore is behind postgres",
 	})
+
+	MetricBackfillChunksRemaining = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "singlestore_backfill_chunks_remaining",
+		Help: "The number of chunks left to replicate in the running backfill",
+	})
+
+	MetricInitLoadChunksRemaining = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "singlestore_init_load_chunks_remaining",
+		Help: "The number of chunks left to copy in the running initial load",
+	})
+
+	MetricReplicationGaps = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "singlestore_replication_gaps",
+		Help: "The number of gaps between the block ranges recorded in replication_meta",
+	})
+
+	MetricReplicationGapHeights = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "singlestore_replication_gap_heights",
+		Help: "The total number of block heights missing from replication_meta",
+	})
+
+	MetricRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "singlestore_retries",
+		Help: "The total number of times an operation was retried after a transient error",
+	}, []string{"operation"})
+
+	MetricReorgs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "singlestore_reorgs",
+		Help: "The total number of chain reorganizations rewound in SingleStore",
+	})
+
+	MetricDeletedRows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "singlestore_deleted_rows",
+		Help: "The total number of rows deleted from SingleStore because they were deleted from Postgres",
+	}, []string{"table"})
+
+	MetricVerifyDivergentRanges = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "singlestore_verify_divergent_ranges",
+		Help: "The number of block ranges whose rows differ between Postgres and SingleStore in the last verify run",
+	}, []string{"table"})
+
+	MetricVerifyMissingRows = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "singlestore_verify_missing_rows",
+		Help: "The number of rows in Postgres which are not in SingleStore across the divergent ranges of the last verify run",
+	}, []string{"table"})
+
+	MetricVerifyExtraRows = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "singlestore_verify_extra_rows",
+		Help: "The number of rows in SingleStore which are not in Postgres across the divergent ranges of the last verify run",
+	}, []string{"table"})
 )
 
-func ServeMetrics(config MetricsConfig) {
-	http.Handle("/metrics", promhttp.Handler())
-	err := http.ListenAndServe(fmt.Sprintf(":%d", config.Port), nil)
-	if err != nil {
-		log.Fatalf("failed to start metrics server: %s", err)
+// ServeMetrics serves the prometheus metrics until ctx is cancelled, at which
+// point the server is gracefully shut down.
+func ServeMetrics(ctx context.Context, config MetricsConfig) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", config.Port),
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
 	}
+	return err
 }
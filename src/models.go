@@ -1,8 +1,11 @@
 package src
 
 import (
+	"database/sql"
 	"log"
+	"math/big"
 	"reflect"
+	"strconv"
 
 	"github.com/hamba/avro"
 	"github.com/iancoleman/strcase"
@@ -12,17 +15,237 @@ import (
 type Model interface {
 	Key() string
 	Table() string
+	Source() Source
+}
+
+// Source describes how to read the rows of a table which belong to a batch
+// from Postgres.
+type Source struct {
+	// Parent is the table whose keys are passed to Query as an array in $1.
+	// If Parent is empty Query is instead passed the lowest and highest block
+	// height which rows updated in place should be read from as $1 and $2.
+	Parent string
+	Query  string
 }
 
 type ModelInfo struct {
 	Table  string
+	Type   reflect.Type
 	Schema avro.Schema
+	Source Source
+
+	// ParquetSchema describes the columns of the model when exported as
+	// Parquet
+	ParquetSchema []string
 
 	// FieldMap translates from the golang field name to the corresponding
 	// column name in SingleStore
 	FieldMap map[string]string
 }
 
+// isDecimal reports whether a field of type t is an Avro decimal.
+func isDecimal(t reflect.Type) bool {
+	return t == ratType || t == reflect.PtrTo(ratType)
+}
+
+// checkDecimals returns an error if a decimal field of row does not fit in
+// decimalPrecision digits.
+func (m ModelInfo) checkDecimals(row Model) error {
+	v := reflect.ValueOf(row).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if !isDecimal(field.Type()) {
+			continue
+		}
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				continue
+			}
+			field = field.Elem()
+		}
+		r := field.Addr().Interface().(*big.Rat)
+		if !r.IsInt() || new(big.Int).Abs(r.Num()).Cmp(maxDecimal) >= 0 {
+			return errors.Errorf("%s %s of %s does not fit in DECIMAL(%d,0)", m.Type.Field(i).Name, r.RatString(), m.Table, decimalPrecision)
+		}
+	}
+	return nil
+}
+
+// New returns a pointer to a new zero value of the model.
+func (m ModelInfo) New() Model {
+	return reflect.New(m.Type).Interface().(Model)
+}
+
+// replicationOnlyColumns are columns of each table which only exist in
+// SingleStore and are maintained by the replication tool.
+var replicationOnlyColumns = map[string][]string{
+	"blocks": {"finalized"},
+}
+
+// decimalPrecision is the precision of the Avro decimal of every big.Rat
+// field, which covers the widest DECIMAL column in SingleStore. Every decimal
+// is an integer, so the scale is always 0.
+const decimalPrecision = 45
+
+// maxDecimal is the lowest integer with more than decimalPrecision digits.
+var maxDecimal = new(big.Int).Exp(big.NewInt(10), big.NewInt(decimalPrecision), nil)
+
+var ratType = reflect.TypeOf(big.Rat{})
+
+// setField sets a field of a model to s, the text form of the value as
+// returned by Postgres. Pointer fields are set to a new value.
+func setField(field reflect.Value, s string) error {
+	if field.Kind() == reflect.Ptr {
+		v := reflect.New(field.Type().Elem())
+		err := setField(v.Elem(), s)
+		if err != nil {
+			return err
+		}
+		field.Set(v)
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Struct:
+		if field.Type() != ratType {
+			return errors.Errorf("type not supported: %s", field.Type())
+		}
+		r, ok := field.Addr().Interface().(*big.Rat).SetString(s)
+		if !ok || !r.IsInt() {
+			return errors.Errorf("invalid decimal: %q", s)
+		}
+	default:
+		return errors.Errorf("type not supported: %s", field.Kind())
+	}
+	return nil
+}
+
+// formatField returns the text form of a field set by setField. A nil
+// pointer is formatted as an empty string.
+func formatField(field reflect.Value) string {
+	if field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			return ""
+		}
+		field = field.Elem()
+	}
+
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(field.Int(), 10)
+	case reflect.Bool:
+		return strconv.FormatBool(field.Bool())
+	case reflect.Struct:
+		if field.Type() == ratType {
+			r := field.Addr().Interface().(*big.Rat)
+			return r.RatString()
+		}
+	}
+	return field.String()
+}
+
+// rowScanner reads rows from Postgres into models, matching columns to
+// fields by their snake case names. Every value is read as text and parsed by
+// setField.
+type rowScanner struct {
+	rows    *sql.Rows
+	columns []string
+	values  []sql.NullString
+	dst     []interface{}
+
+	// fields has the index of the field of each column in typ
+	typ    reflect.Type
+	fields []int
+}
+
+func newRowScanner(rows *sql.Rows) (*rowScanner, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	s := &rowScanner{
+		rows:    rows,
+		columns: columns,
+		values:  make([]sql.NullString, len(columns)),
+		dst:     make([]interface{}, len(columns)),
+	}
+	for i := range s.values {
+		s.dst[i] = &s.values[i]
+	}
+	return s, nil
+}
+
+func (s *rowScanner) mapFields(typ reflect.Type) error {
+	byColumn := make(map[string]int)
+	for i := 0; i < typ.NumField(); i++ {
+		byColumn[strcase.ToSnake(typ.Field(i).Name)] = i
+	}
+
+	fields := make([]int, len(s.columns))
+	for i, column := range s.columns {
+		field, ok := byColumn[column]
+		if !ok {
+			return errors.Errorf("column %s has no field in %s", column, typ.Name())
+		}
+		fields[i] = field
+	}
+	s.typ = typ
+	s.fields = fields
+	return nil
+}
+
+// Scan reads the current row into dst, which must be a pointer to a model.
+// Fields without a column are left unchanged.
+func (s *rowScanner) Scan(dst Model) error {
+	v := reflect.ValueOf(dst).Elem()
+	if v.Type() != s.typ {
+		err := s.mapFields(v.Type())
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.rows.Scan(s.dst...)
+	if err != nil {
+		return err
+	}
+	return s.setFields(v)
+}
+
+// setFields sets the fields of v, a model of the mapped type, to the values
+// of the current row.
+func (s *rowScanner) setFields(v reflect.Value) error {
+	for i, column := range s.columns {
+		field := v.Field(s.fields[i])
+		if !s.values[i].Valid {
+			if field.Kind() != reflect.Ptr {
+				return errors.Errorf("column %s is unexpectedly null", column)
+			}
+			field.Set(reflect.Zero(field.Type()))
+			continue
+		}
+		err := setField(field, s.values[i].String)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read column %s", column)
+		}
+	}
+	return nil
+}
+
 var Models []ModelInfo
 
 func init() {
@@ -49,14 +272,31 @@ func init() {
 		if err != nil {
 			panic(err)
 		}
+		parquetSchema, err := GenerateParquetSchema(model, fieldMap)
+		if err != nil {
+			panic(err)
+		}
 		Models = append(Models, ModelInfo{
-			Table:    model.Table(),
-			Schema:   schema,
-			FieldMap: fieldMap,
+			Table:         model.Table(),
+			Type:          reflect.TypeOf(model).Elem(),
+			Schema:        schema,
+			Source:        model.Source(),
+			ParquetSchema: parquetSchema,
+			FieldMap:      fieldMap,
 		})
 	}
+
+	var err error
+	DefaultTableGraph, err = NewTableGraph(Models)
+	if err != nil {
+		panic(err)
+	}
 }
 
+// GenerateSchemaAndFieldMap returns the Avro schema of a model along with the
+// SingleStore column of every field. Fields are typed to match their columns
+// in schema.sql: big.Rat fields are decimals for DECIMAL columns and int64
+// fields are longs for BIGINT ids and indexes. Pointer fields are nullable.
 func GenerateSchemaAndFieldMap(m interface{}) (avro.Schema, map[string]string, error) {
 	mType := reflect.TypeOf(m)
 
@@ -67,7 +307,12 @@ func GenerateSchemaAndFieldMap(m interface{}) (avro.Schema, map[string]string, e
 	if mType.Kind() != reflect.Struct {
 		return nil, nil, errors.New("can only generate Avro schema for a struct")
 	}
+	return generateSchema(mType, mType.Name())
+}
 
+// generateSchema returns the Avro schema of a struct type as a record with
+// the provided name, along with the column of every field.
+func generateSchema(mType reflect.Type, name string) (avro.Schema, map[string]string, error) {
 	fields := make([]*avro.Field, 0, mType.NumField())
 	fieldMap := make(map[string]string)
 	for i := 0; i < mType.NumField(); i++ {
@@ -77,6 +322,7 @@ func GenerateSchemaAndFieldMap(m interface{}) (avro.Schema, map[string]string, e
 		fieldMap[f.Name] = strcase.ToSnake(f.Name)
 
 		var schemaType avro.Type
+		var logicalSchema avro.LogicalSchema
 		var nullable bool
 
 		if fType.Kind() == reflect.Ptr {
@@ -87,6 +333,12 @@ func GenerateSchemaAndFieldMap(m interface{}) (avro.Schema, map[string]string, e
 		switch fType.Kind() {
 		case reflect.String:
 			schemaType = avro.String
+		case reflect.Struct:
+			if fType != ratType {
+				log.Fatalf("type not supported: %s", fType)
+			}
+			schemaType = avro.Bytes
+			logicalSchema = avro.NewDecimalLogicalSchema(decimalPrecision, 0)
 		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
 			schemaType = avro.Int
 		case reflect.Int64:
@@ -101,7 +353,7 @@ func GenerateSchemaAndFieldMap(m interface{}) (avro.Schema, map[string]string, e
 			log.Fatalf("type not supported: %s", fType.Kind())
 		}
 
-		var fieldSchema avro.Schema = avro.NewPrimitiveSchema(schemaType, nil)
+		var fieldSchema avro.Schema = avro.NewPrimitiveSchema(schemaType, logicalSchema)
 		var err error
 		if nullable {
 			fieldSchema, err = avro.NewUnionSchema([]avro.Schema{fieldSchema, &avro.NullSchema{}})
@@ -117,7 +369,7 @@ func GenerateSchemaAndFieldMap(m interface{}) (avro.Schema, map[string]string, e
 		fields = append(fields, field)
 	}
 
-	schema, err := avro.NewRecordSchema(mType.Name(), "com.singlestore", fields)
+	schema, err := avro.NewRecordSchema(name, "com.singlestore", fields)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -131,7 +383,7 @@ type AccessKey struct {
 	CreatedByReceiptId    *string
 	DeletedByReceiptId    *string
 	PermissionKind        string
-	LastUpdateBlockHeight string
+	LastUpdateBlockHeight big.Rat
 }
 
 func (m *AccessKey) Key() string {
@@ -142,61 +394,87 @@ func (m *AccessKey) Table() string {
 	return "access_keys"
 }
 
+func (m *AccessKey) Source() Source {
+	return Source{
+		Query: "select * from access_keys where last_update_block_height >= $1 and last_update_block_height <= $2",
+	}
+}
+
 type AccountChange struct {
-	Id                              string
+	Id                              int64
 	AffectedAccountId               string
-	ChangedInBlockTimestamp         string
+	ChangedInBlockTimestamp         big.Rat
 	ChangedInBlockHash              string
 	CausedByTransactionHash         *string
 	CausedByReceiptId               *string
 	UpdateReason                    string
-	AffectedAccountNonstakedBalance string
-	AffectedAccountStakedBalance    string
-	AffectedAccountStorageUsage     string
+	AffectedAccountNonstakedBalance big.Rat
+	AffectedAccountStakedBalance    big.Rat
+	AffectedAccountStorageUsage     big.Rat
 }
 
 func (m *AccountChange) Key() string {
-	return m.Id
+	return strconv.FormatInt(m.Id, 10)
 }
 
 func (m *AccountChange) Table() string {
 	return "account_changes"
 }
 
+func (m *AccountChange) Source() Source {
+	return Source{
+		Parent: "blocks",
+		Query:  "select * from account_changes where changed_in_block_hash = ANY($1)",
+	}
+}
+
 type Account struct {
-	Id                    string
+	Id                    int64
 	AccountId             string
 	CreatedByReceiptId    *string
 	DeletedByReceiptId    *string
-	LastUpdateBlockHeight string
+	LastUpdateBlockHeight big.Rat
 }
 
 func (m *Account) Key() string {
-	return m.Id
+	return strconv.FormatInt(m.Id, 10)
 }
 
 func (m *Account) Table() string {
 	return "accounts"
 }
 
+func (m *Account) Source() Source {
+	return Source{
+		Query: "select * from accounts where last_update_block_height >= $1 and last_update_block_height <= $2",
+	}
+}
+
 type ActionReceiptAction struct {
 	ReceiptId                       string
-	IndexInActionReceipt            string
+	IndexInActionReceipt            int64
 	ActionKind                      string
 	Args                            string
 	ReceiptPredecessorAccountId     string
 	ReceiptReceiverAccountId        string
-	ReceiptIncludedInBlockTimestamp string
+	ReceiptIncludedInBlockTimestamp big.Rat
 }
 
 func (m *ActionReceiptAction) Key() string {
-	return m.ReceiptId + ":" + m.IndexInActionReceipt
+	return m.ReceiptId + ":" + strconv.FormatInt(m.IndexInActionReceipt, 10)
 }
 
 func (m *ActionReceiptAction) Table() string {
 	return "action_receipt_actions"
 }
 
+func (m *ActionReceiptAction) Source() Source {
+	return Source{
+		Parent: "receipts",
+		Query:  "select * from action_receipt_actions where receipt_id = ANY($1)",
+	}
+}
+
 type ActionReceiptInputData struct {
 	InputDataId      string
 	InputToReceiptId string
@@ -210,6 +488,13 @@ func (m *ActionReceiptInputData) Table() string {
 	return "action_receipt_input_data"
 }
 
+func (m *ActionReceiptInputData) Source() Source {
+	return Source{
+		Parent: "receipts",
+		Query:  "select * from action_receipt_input_data where input_to_receipt_id = ANY($1)",
+	}
+}
+
 type ActionReceiptOutputData struct {
 	OutputDataId        string
 	OutputFromReceiptId string
@@ -224,11 +509,18 @@ func (m *ActionReceiptOutputData) Table() string {
 	return "action_receipt_output_data"
 }
 
+func (m *ActionReceiptOutputData) Source() Source {
+	return Source{
+		Parent: "receipts",
+		Query:  "select * from action_receipt_output_data where output_from_receipt_id = ANY($1)",
+	}
+}
+
 type ActionReceipt struct {
 	ReceiptId       string
 	SignerAccountId string
 	SignerPublicKey string
-	GasPrice        string
+	GasPrice        big.Rat
 }
 
 func (m *ActionReceipt) Key() string {
@@ -239,31 +531,52 @@ func (m *ActionReceipt) Table() string {
 	return "action_receipts"
 }
 
+func (m *ActionReceipt) Source() Source {
+	return Source{
+		Parent: "receipts",
+		Query:  "select * from action_receipts where receipt_id = ANY($1)",
+	}
+}
+
 type Block struct {
-	BlockHeight     string
+	BlockHeight     big.Rat
 	BlockHash       string
 	PrevBlockHash   string
-	BlockTimestamp  string
-	TotalSupply     string
-	GasPrice        string
+	BlockTimestamp  big.Rat
+	TotalSupply     big.Rat
+	GasPrice        big.Rat
 	AuthorAccountId string
+
+	// Finalized is false for blocks replicated optimistically, before they
+	// were ConfirmationDepth blocks below the Postgres head
+	Finalized bool
 }
 
 func (m *Block) Key() string {
 	return m.BlockHash
 }
 
+// Height returns the height of the block as an integer.
+func (m *Block) Height() *big.Int {
+	return (&big.Int{}).Set(m.BlockHeight.Num())
+}
+
 func (m *Block) Table() string {
 	return "blocks"
 }
 
+func (m *Block) Source() Source {
+	// blocks are the root of the table graph and are read by Extract
+	return Source{}
+}
+
 type Chunk struct {
 	IncludedInBlockHash string
 	ChunkHash           string
-	ShardId             string
+	ShardId             int64
 	Signature           string
-	GasLimit            string
-	GasUsed             string
+	GasLimit            big.Rat
+	GasUsed             big.Rat
 	AuthorAccountId     string
 }
 
@@ -275,6 +588,13 @@ func (m *Chunk) Table() string {
 	return "chunks"
 }
 
+func (m *Chunk) Source() Source {
+	return Source{
+		Parent: "blocks",
+		Query:  "select * from chunks where included_in_block_hash = ANY($1)",
+	}
+}
+
 type DataReceipt struct {
 	DataId    string
 	ReceiptId string
@@ -289,30 +609,44 @@ func (m *DataReceipt) Table() string {
 	return "data_receipts"
 }
 
+func (m *DataReceipt) Source() Source {
+	return Source{
+		Parent: "receipts",
+		Query:  "select * from data_receipts where receipt_id = ANY($1)",
+	}
+}
+
 type ExecutionOutcomeReceipt struct {
 	ExecutedReceiptId       string
-	IndexInExecutionOutcome string
+	IndexInExecutionOutcome int64
 	ProducedReceiptId       string
 }
 
 func (m *ExecutionOutcomeReceipt) Key() string {
-	return m.ExecutedReceiptId + ":" + m.IndexInExecutionOutcome
+	return m.ExecutedReceiptId + ":" + strconv.FormatInt(m.IndexInExecutionOutcome, 10)
 }
 
 func (m *ExecutionOutcomeReceipt) Table() string {
 	return "execution_outcome_receipts"
 }
 
+func (m *ExecutionOutcomeReceipt) Source() Source {
+	return Source{
+		Parent: "receipts",
+		Query:  "select * from execution_outcome_receipts where executed_receipt_id = ANY($1) or produced_receipt_id = ANY($1)",
+	}
+}
+
 type ExecutionOutcome struct {
 	ReceiptId                string
 	ExecutedInBlockHash      string
-	ExecutedInBlockTimestamp string
-	IndexInChunk             string
-	GasBurnt                 string
-	TokensBurnt              string
+	ExecutedInBlockTimestamp big.Rat
+	IndexInChunk             int64
+	GasBurnt                 big.Rat
+	TokensBurnt              big.Rat
 	ExecutorAccountId        string
 	Status                   string
-	ShardID                  string
+	ShardID                  big.Rat
 }
 
 func (m *ExecutionOutcome) Key() string {
@@ -323,12 +657,23 @@ func (m *ExecutionOutcome) Table() string {
 	return "execution_outcomes"
 }
 
+func (m *ExecutionOutcome) Accounts() []string {
+	return []string{m.ExecutorAccountId}
+}
+
+func (m *ExecutionOutcome) Source() Source {
+	return Source{
+		Parent: "blocks",
+		Query:  "select * from execution_outcomes where executed_in_block_hash = ANY($1)",
+	}
+}
+
 type Receipt struct {
 	ReceiptId                     string
 	IncludedInBlockHash           string
 	IncludedInChunkHash           string
-	IndexInChunk                  string
-	IncludedInBlockTimestamp      string
+	IndexInChunk                  int64
+	IncludedInBlockTimestamp      big.Rat
 	PredecessorAccountId          string
 	ReceiverAccountId             string
 	ReceiptKind                   string
@@ -343,9 +688,20 @@ func (m *Receipt) Table() string {
 	return "receipts"
 }
 
+func (m *Receipt) Accounts() []string {
+	return []string{m.PredecessorAccountId, m.ReceiverAccountId}
+}
+
+func (m *Receipt) Source() Source {
+	return Source{
+		Parent: "blocks",
+		Query:  "select * from receipts where included_in_block_hash = ANY($1)",
+	}
+}
+
 type TransactionAction struct {
 	TransactionHash    string
-	IndexInTransaction string
+	IndexInTransaction int64
 	ActionKind         string
 	Args               string
 }
@@ -358,21 +714,28 @@ func (m *TransactionAction) Table() string {
 	return "transaction_actions"
 }
 
+func (m *TransactionAction) Source() Source {
+	return Source{
+		Parent: "transactions",
+		Query:  "select * from transaction_actions where transaction_hash = ANY($1)",
+	}
+}
+
 type Transaction struct {
 	TransactionHash              string
 	IncludedInBlockHash          string
 	IncludedInChunkHash          string
-	IndexInChunk                 string
-	BlockTimestamp               string
+	IndexInChunk                 int64
+	BlockTimestamp               big.Rat
 	SignerAccountId              string
 	SignerPublicKey              string
-	Nonce                        string
+	Nonce                        big.Rat
 	ReceiverAccountId            string
 	Signature                    string
 	Status                       string
 	ConvertedIntoReceiptId       string
-	ReceiptConversionGasBurnt    string
-	ReceiptConversionTokensBurnt string
+	ReceiptConversionGasBurnt    big.Rat
+	ReceiptConversionTokensBurnt big.Rat
 }
 
 func (m *Transaction) Key() string {
@@ -382,3 +745,14 @@ func (m *Transaction) Key() string {
 func (m *Transaction) Table() string {
 	return "transactions"
 }
+
+func (m *Transaction) Accounts() []string {
+	return []string{m.SignerAccountId, m.ReceiverAccountId}
+}
+
+func (m *Transaction) Source() Source {
+	return Source{
+		Parent: "blocks",
+		Query:  "select * from transactions where included_in_block_hash = ANY($1)",
+	}
+}
@@ -0,0 +1,168 @@
+package src
+
+import (
+	"database/sql"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type fieldTestModel struct {
+	Text     string
+	Count    int64
+	Shard    int32
+	Flag     bool
+	Amount   big.Rat
+	Optional *big.Rat
+	Note     *string
+}
+
+func TestSetFieldRoundTrip(t *testing.T) {
+	tests := []struct {
+		field string
+		value string
+	}{
+		{"Text", ""},
+		{"Text", "hello\tworld"},
+		{"Count", "-9223372036854775808"},
+		{"Count", "9223372036854775807"},
+		{"Shard", "2147483647"},
+		{"Flag", "true"},
+		{"Flag", "false"},
+		{"Amount", "0"},
+		{"Amount", "-17"},
+		{"Amount", "123456789012345678901234567890123456789012345"},
+		{"Optional", "42"},
+		{"Note", "note"},
+	}
+	for _, tt := range tests {
+		v := reflect.ValueOf(&fieldTestModel{}).Elem()
+		field := v.FieldByName(tt.field)
+		err := setField(field, tt.value)
+		if err != nil {
+			t.Errorf("setField(%s, %q): %v", tt.field, tt.value, err)
+			continue
+		}
+		if got := formatField(field); got != tt.value {
+			t.Errorf("formatField(setField(%s, %q)) = %q", tt.field, tt.value, got)
+		}
+	}
+}
+
+func TestSetFieldErrors(t *testing.T) {
+	tests := []struct {
+		field string
+		value string
+	}{
+		{"Amount", "1.5"},
+		{"Amount", "1/2"},
+		{"Amount", "abc"},
+		{"Amount", ""},
+		{"Optional", "0.25"},
+		{"Shard", "2147483648"},
+		{"Shard", "-2147483649"},
+		{"Count", "9223372036854775808"},
+		{"Count", "1.0"},
+		{"Flag", "yes please"},
+	}
+	for _, tt := range tests {
+		v := reflect.ValueOf(&fieldTestModel{}).Elem()
+		if err := setField(v.FieldByName(tt.field), tt.value); err == nil {
+			t.Errorf("setField(%s, %q) succeeded", tt.field, tt.value)
+		}
+	}
+
+	// a failed pointer field is left nil
+	m := &fieldTestModel{}
+	_ = setField(reflect.ValueOf(m).Elem().FieldByName("Optional"), "0.5")
+	if m.Optional != nil {
+		t.Errorf("Optional = %v after a failed setField", m.Optional)
+	}
+}
+
+func TestFormatFieldNil(t *testing.T) {
+	v := reflect.ValueOf(&fieldTestModel{}).Elem()
+	if got := formatField(v.FieldByName("Optional")); got != "" {
+		t.Errorf("formatField(nil) = %q", got)
+	}
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: true}
+}
+
+func TestRowScannerSetFields(t *testing.T) {
+	typ := reflect.TypeOf(fieldTestModel{})
+	tests := []struct {
+		name    string
+		columns []string
+		values  []sql.NullString
+		before  fieldTestModel
+		err     string
+		want    fieldTestModel
+	}{
+		{
+			name:    "every column",
+			columns: []string{"text", "count", "shard", "flag", "amount", "optional", "note"},
+			values:  []sql.NullString{nullString("a"), nullString("1"), nullString("2"), nullString("true"), nullString("3"), nullString("4"), nullString("n")},
+			want:    fieldTestModel{Text: "a", Count: 1, Shard: 2, Flag: true, Amount: *big.NewRat(3, 1), Optional: big.NewRat(4, 1), Note: strPtr("n")},
+		},
+		{
+			name:    "null into pointers",
+			columns: []string{"amount", "optional", "note"},
+			values:  []sql.NullString{nullString("3"), {}, {}},
+			before:  fieldTestModel{Optional: big.NewRat(9, 1), Note: strPtr("old")},
+			want:    fieldTestModel{Amount: *big.NewRat(3, 1)},
+		},
+		{
+			name:    "null into a non-pointer",
+			columns: []string{"amount"},
+			values:  []sql.NullString{{}},
+			err:     "column amount is unexpectedly null",
+		},
+		{
+			name:    "non-integer decimal",
+			columns: []string{"amount"},
+			values:  []sql.NullString{nullString("1.5")},
+			err:     "failed to read column amount",
+		},
+		{
+			name:    "int32 overflow",
+			columns: []string{"shard"},
+			values:  []sql.NullString{nullString("4294967296")},
+			err:     "failed to read column shard",
+		},
+		{
+			name:    "column without a field",
+			columns: []string{"text", "missing"},
+			err:     "column missing has no field in fieldTestModel",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &rowScanner{columns: tt.columns, values: tt.values}
+			got := tt.before
+			err := s.mapFields(typ)
+			if err == nil {
+				err = s.setFields(reflect.ValueOf(&got).Elem())
+			}
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,428 @@
+package src
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/xitongsys/parquet-go/types"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// manifestDir is the directory below ParquetSink.Dir which holds the manifest
+// of every committed batch
+const manifestDir = "_manifests"
+
+// GenerateParquetSchema returns the Parquet schema of a model in the
+// metadata format of parquet-go's CSV writer, with one column per field
+// named by fieldMap, the SingleStore column of every field.
+func GenerateParquetSchema(m interface{}, fieldMap map[string]string) ([]string, error) {
+	mType := reflect.TypeOf(m)
+
+	if mType.Kind() == reflect.Ptr {
+		mType = mType.Elem()
+	}
+
+	if mType.Kind() != reflect.Struct {
+		return nil, errors.New("can only generate Parquet schema for a struct")
+	}
+
+	out := make([]string, 0, mType.NumField())
+	for i := 0; i < mType.NumField(); i++ {
+		f := mType.Field(i)
+		fType := f.Type
+
+		repetition := "REQUIRED"
+		if fType.Kind() == reflect.Ptr {
+			fType = fType.Elem()
+			repetition = "OPTIONAL"
+		}
+
+		var columnType string
+		switch fType.Kind() {
+		case reflect.String:
+			columnType = "type=BYTE_ARRAY, convertedtype=UTF8"
+		case reflect.Struct:
+			if fType != ratType {
+				return nil, errors.Errorf("type not supported: %s", fType)
+			}
+			columnType = fmt.Sprintf("type=BYTE_ARRAY, convertedtype=DECIMAL, precision=%d, scale=0", decimalPrecision)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+			columnType = "type=INT32"
+		case reflect.Int64:
+			columnType = "type=INT64"
+		case reflect.Float32:
+			columnType = "type=FLOAT"
+		case reflect.Float64:
+			columnType = "type=DOUBLE"
+		case reflect.Bool:
+			columnType = "type=BOOLEAN"
+		default:
+			return nil, errors.Errorf("type not supported: %s", fType.Kind())
+		}
+
+		column, ok := fieldMap[f.Name]
+		if !ok {
+			return nil, errors.Errorf("no column for field %s", f.Name)
+		}
+		out = append(out, fmt.Sprintf("name=%s, %s, repetitiontype=%s", column, columnType, repetition))
+	}
+	return out, nil
+}
+
+// parquetValues converts row into the values of its Parquet columns.
+func parquetValues(row Model) []interface{} {
+	v := reflect.ValueOf(row).Elem()
+	out := make([]interface{}, v.NumField())
+	for i := range out {
+		field := v.Field(i)
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				continue
+			}
+			field = field.Elem()
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			out[i] = field.String()
+		case reflect.Struct:
+			// decimals are stored as big endian two's complement
+			r := field.Addr().Interface().(*big.Rat)
+			out[i] = types.StrIntToBinary(r.Num().String(), "BigEndian", 0, true)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+			out[i] = int32(field.Int())
+		case reflect.Int64:
+			out[i] = field.Int()
+		case reflect.Float32:
+			out[i] = float32(field.Float())
+		case reflect.Float64:
+			out[i] = field.Float()
+		case reflect.Bool:
+			out[i] = field.Bool()
+		}
+	}
+	return out
+}
+
+// ParquetSink writes every batch as one Parquet file per table, partitioned
+// by table and block height range:
+//
+//	<dir>/<table>/<start height>-<end height>.parquet
+//
+// along with a manifest at <dir>/_manifests/<start height>-<end height>.json
+// which records the range and the number of rows in each file. Heights are
+// zero padded so that files sort by height. Batches committed without a
+// range, such as repairs, are named by a random ID instead. A batch committed
+// from the same start height as an earlier one, such as a batch retried after
+// SingleStore failed to commit it, replaces the earlier batch.
+//
+// Rewinds of SingleStore after a chain reorganization are recorded as
+// manifests named rewind-<height>-<random ID>.json with only a rewind height:
+// rows of the blocks above it in the batches committed before the rewind are
+// from orphaned blocks.
+//
+// Files are written under temporary names and renamed when the batch is
+// committed, with the manifest renamed last, so readers should only read
+// files listed in a manifest.
+type ParquetSink struct {
+	Dir string
+}
+
+func NewParquetSink(dir string) *ParquetSink {
+	return &ParquetSink{Dir: dir}
+}
+
+// RecordRewind writes a manifest recording a rewind of SingleStore to height.
+func (s *ParquetSink) RecordRewind(height *big.Int) error {
+	id := uuid.NewV4().String()
+	manifest := parquetManifest{
+		RewindHeight: height,
+		CommittedAt:  time.Now().UTC(),
+	}
+	err := writeParquetManifest(s.Dir, id, fmt.Sprintf("rewind-%020d-%s", height, id), manifest)
+	return errors.Wrap(err, "failed to record rewind")
+}
+
+// Begin creates a temporary file for every table loaded by tables.
+func (s *ParquetSink) Begin(tables *TableGraph) (SinkBatch, error) {
+	b := &parquetBatch{
+		dir:     s.Dir,
+		id:      uuid.NewV4().String(),
+		files:   make(map[string]*parquetFile),
+		deleted: make(map[string][]map[string]string),
+	}
+
+	for _, model := range Models {
+		if !tables.Loads(model.Table) {
+			continue
+		}
+		f, err := b.create(model)
+		if err != nil {
+			b.Abort()
+			return nil, errors.Wrapf(err, "failed to create parquet file for %s", model.Table)
+		}
+		b.files[model.Table] = f
+	}
+	return b, nil
+}
+
+type parquetBatch struct {
+	dir             string
+	id              string
+	files           map[string]*parquetFile
+	deleted         map[string][]map[string]string
+	finalizedHeight *big.Int
+}
+
+type parquetFile struct {
+	model ModelInfo
+	path  string
+	file  *os.File
+	buf   *bufio.Writer
+	w     *writer.CSVWriter
+	rows  int64
+}
+
+func (b *parquetBatch) create(model ModelInfo) (*parquetFile, error) {
+	dir := filepath.Join(b.dir, model.Table)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, "."+b.id+".parquet.tmp")
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(file)
+	w, err := writer.NewCSVWriterFromWriter(model.ParquetSchema, buf, 1)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+
+	return &parquetFile{model: model, path: path, file: file, buf: buf, w: w}, nil
+}
+
+func (b *parquetBatch) WriteRow(table string, row Model) error {
+	f, ok := b.files[table]
+	if !ok {
+		return errors.Errorf("no table with name %s", table)
+	}
+
+	err := f.w.Write(parquetValues(row))
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s to parquet", table)
+	}
+	f.rows++
+	return nil
+}
+
+// Delete records the key of row in the manifest, since Parquet files can not
+// be changed once they are written.
+func (b *parquetBatch) Delete(table string, row Model) error {
+	f, ok := b.files[table]
+	if !ok {
+		return errors.Errorf("no table with name %s", table)
+	}
+
+	key := make(map[string]string)
+	v := reflect.ValueOf(row).Elem()
+	for _, field := range deleteKeys[table] {
+		key[f.model.FieldMap[field]] = formatField(v.FieldByName(field))
+	}
+	b.deleted[table] = append(b.deleted[table], key)
+	return nil
+}
+
+// Finalize records height in the manifest.
+func (b *parquetBatch) Finalize(height *big.Int) error {
+	b.finalizedHeight = height
+	return nil
+}
+
+// parquetManifest describes the files written for one batch.
+type parquetManifest struct {
+	StartHeight     *big.Int                 `json:"start_height"`
+	EndHeight       *big.Int                 `json:"end_height"`
+	FinalizedHeight *big.Int                 `json:"finalized_height,omitempty"`
+	CommittedAt     time.Time                `json:"committed_at"`
+	Tables          map[string]parquetOutput `json:"tables,omitempty"`
+
+	// Deleted holds the key columns of the rows deleted by the batch
+	Deleted map[string][]map[string]string `json:"deleted,omitempty"`
+
+	// RewindHeight is set instead of the tables if SingleStore was rewound
+	// to this height after a chain reorganization
+	RewindHeight *big.Int `json:"rewind_height,omitempty"`
+}
+
+// writeParquetManifest writes manifest under a temporary name derived from id
+// and then moves it into place as name.
+func writeParquetManifest(dir string, id string, name string, manifest parquetManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(dir, manifestDir), 0755)
+	if err != nil {
+		return errors.Wrap(err, "failed to create manifest directory")
+	}
+	tmp := filepath.Join(dir, manifestDir, "."+id+".json.tmp")
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "failed to write manifest")
+	}
+	return errors.Wrap(os.Rename(tmp, filepath.Join(dir, manifestDir, name+".json")), "failed to move manifest")
+}
+
+type parquetOutput struct {
+	// File is relative to the export directory
+	File string `json:"file"`
+	Rows int64  `json:"rows"`
+}
+
+// Commit finishes every file and moves it to its final name, then writes the
+// manifest and removes the batches it replaces. Committing the same range
+// again replaces the files. If Commit fails the files which were not moved
+// yet are removed.
+func (b *parquetBatch) Commit(ctx context.Context, startHeight *big.Int, endHeight *big.Int) (err error) {
+	defer func() {
+		if err != nil {
+			b.Abort()
+		}
+	}()
+
+	name := b.id
+	if startHeight != nil && endHeight != nil {
+		name = fmt.Sprintf("%020d-%020d", startHeight, endHeight)
+	}
+
+	manifest := parquetManifest{
+		StartHeight:     startHeight,
+		EndHeight:       endHeight,
+		FinalizedHeight: b.finalizedHeight,
+		Tables:          make(map[string]parquetOutput),
+		Deleted:         b.deleted,
+	}
+
+	for table, f := range b.files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err := f.close()
+		if err != nil {
+			return errors.Wrapf(err, "failed to finish parquet file for %s", table)
+		}
+		file := filepath.Join(table, name+".parquet")
+		err = os.Rename(f.path, filepath.Join(b.dir, file))
+		if err != nil {
+			return errors.Wrapf(err, "failed to move parquet file for %s", table)
+		}
+		f.path = ""
+		manifest.Tables[table] = parquetOutput{File: file, Rows: f.rows}
+	}
+
+	manifest.CommittedAt = time.Now().UTC()
+	err = writeParquetManifest(b.dir, b.id, name, manifest)
+	if err != nil {
+		return err
+	}
+
+	if startHeight != nil && endHeight != nil {
+		err = b.removeReplaced(startHeight, name)
+		if err != nil {
+			return errors.Wrap(err, "failed to remove replaced batches")
+		}
+	}
+	return nil
+}
+
+// removeReplaced removes the batches other than the one named name which were
+// committed from startHeight. Replication only starts a batch at the same
+// height again when the earlier batch was not committed to SingleStore, or
+// was rewound from it, or when backfill replicates the blocks again. The
+// manifest is removed before the files, so that a manifest never lists
+// missing files.
+func (b *parquetBatch) removeReplaced(startHeight *big.Int, name string) error {
+	paths, err := filepath.Glob(filepath.Join(b.dir, manifestDir, fmt.Sprintf("%020d-*.json", startHeight)))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if filepath.Base(path) == name+".json" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var replaced parquetManifest
+		err = json.Unmarshal(data, &replaced)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+		for _, output := range replaced.Tables {
+			err = os.Remove(filepath.Join(b.dir, output.File))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// close writes the footer of the file and closes it.
+func (f *parquetFile) close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.w.WriteStop()
+	if err == nil {
+		err = f.buf.Flush()
+	}
+	closeErr := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Abort removes every file which has not been committed.
+func (b *parquetBatch) Abort() error {
+	var lastError error
+	for _, f := range b.files {
+		if f.file != nil {
+			f.file.Close()
+			f.file = nil
+		}
+		if f.path == "" {
+			continue
+		}
+		err := os.Remove(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			lastError = err
+		}
+	}
+	return lastError
+}
@@ -0,0 +1,221 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/types"
+)
+
+func readParquetColumns(t *testing.T, path string) (map[string][]interface{}, int64) {
+	t.Helper()
+	file, err := local.NewLocalFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	r, err := reader.NewParquetColumnReader(file, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.ReadStop()
+
+	rows := r.GetNumRows()
+	out := make(map[string][]interface{})
+	// the first schema element is the root
+	for i, info := range r.SchemaHandler.Infos[1:] {
+		values, _, _, err := r.ReadColumnByIndex(int64(i), rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[info.ExName] = values
+	}
+	return out, rows
+}
+
+func TestParquetSinkRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tables, err := DefaultTableGraph.Select([]string{"chunks", "access_keys"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := NewParquetSink(dir).Begin(tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := "receipt"
+	gasLimit, _ := new(big.Rat).SetString("1000000000000000000000000000000")
+	rows := []struct {
+		table string
+		row   Model
+	}{
+		{"chunks", &Chunk{IncludedInBlockHash: "block", ChunkHash: "a", ShardId: 3, Signature: "sig", GasLimit: *gasLimit, GasUsed: *big.NewRat(-5, 1), AuthorAccountId: "author"}},
+		{"chunks", &Chunk{IncludedInBlockHash: "block", ChunkHash: "b"}},
+		{"access_keys", &AccessKey{PublicKey: "key", AccountId: "account", CreatedByReceiptId: &created, PermissionKind: "FULL_ACCESS", LastUpdateBlockHeight: *big.NewRat(7, 1)}},
+	}
+	for _, r := range rows {
+		err = batch.WriteRow(r.table, r.row)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = batch.Commit(context.Background(), big.NewInt(5), big.NewInt(9))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestDir, "00000000000000000005-00000000000000000009.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest parquetManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Tables["chunks"].Rows != 2 || manifest.Tables["access_keys"].Rows != 1 {
+		t.Fatalf("unexpected manifest: %+v", manifest.Tables)
+	}
+
+	chunks, n := readParquetColumns(t, filepath.Join(dir, manifest.Tables["chunks"].File))
+	if n != 2 {
+		t.Fatalf("read %d chunks, want 2", n)
+	}
+	decimal := func(s string) interface{} {
+		return types.StrIntToBinary(s, "BigEndian", 0, true)
+	}
+	wantChunks := map[string][]interface{}{
+		"included_in_block_hash": {"block", "block"},
+		"chunk_hash":             {"a", "b"},
+		"shard_id":               {int64(3), int64(0)},
+		"signature":              {"sig", ""},
+		"gas_limit":              {decimal("1000000000000000000000000000000"), decimal("0")},
+		"gas_used":               {decimal("-5"), decimal("0")},
+		"author_account_id":      {"author", ""},
+	}
+	if !reflect.DeepEqual(chunks, wantChunks) {
+		t.Errorf("chunks = %v, want %v", chunks, wantChunks)
+	}
+
+	keys, n := readParquetColumns(t, filepath.Join(dir, manifest.Tables["access_keys"].File))
+	if n != 1 {
+		t.Fatalf("read %d access keys, want 1", n)
+	}
+	wantKeys := map[string][]interface{}{
+		"public_key":               {"key"},
+		"account_id":               {"account"},
+		"created_by_receipt_id":    {"receipt"},
+		"deleted_by_receipt_id":    {nil},
+		"permission_kind":          {"FULL_ACCESS"},
+		"last_update_block_height": {decimal("7")},
+	}
+	if !reflect.DeepEqual(keys, wantKeys) {
+		t.Errorf("access keys = %v, want %v", keys, wantKeys)
+	}
+}
+
+// listParquetDir returns every file below dir relative to it, other than
+// temporary files.
+func listParquetDir(t *testing.T, dir string) []string {
+	t.Helper()
+	var out []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err == nil && filepath.Ext(rel) != ".tmp" {
+			out = append(out, rel)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestParquetSinkReplacesAndRewinds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := NewParquetSink(dir)
+	tables, err := DefaultTableGraph.Select([]string{"blocks"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(start, end int64) {
+		t.Helper()
+		batch, err := sink.Begin(tables)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = batch.Commit(context.Background(), big.NewInt(start), big.NewInt(end))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commit(1, 4)
+	commit(5, 9)
+	// retried with fewer blocks after SingleStore failed to commit 5-9
+	commit(5, 7)
+	err = sink.RecordRewind(big.NewInt(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit(7, 12)
+
+	files := listParquetDir(t, dir)
+	var rewind string
+	for _, f := range files {
+		if matched, _ := filepath.Match(filepath.Join(manifestDir, "rewind-00000000000000000006-*.json"), f); matched {
+			rewind = f
+		}
+	}
+	want := []string{
+		filepath.Join(manifestDir, "00000000000000000001-00000000000000000004.json"),
+		filepath.Join(manifestDir, "00000000000000000005-00000000000000000007.json"),
+		filepath.Join(manifestDir, "00000000000000000007-00000000000000000012.json"),
+		rewind,
+		filepath.Join("blocks", "00000000000000000001-00000000000000000004.parquet"),
+		filepath.Join("blocks", "00000000000000000005-00000000000000000007.parquet"),
+		filepath.Join("blocks", "00000000000000000007-00000000000000000012.parquet"),
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("files = %v, want %v", files, want)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, rewind))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest parquetManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.RewindHeight == nil || manifest.RewindHeight.Int64() != 6 || len(manifest.Tables) != 0 {
+		t.Errorf("unexpected rewind manifest: %s", data)
+	}
+}
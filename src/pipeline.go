@@ -0,0 +1,94 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"math/big"
+	"time"
+)
+
+// ReplicatePipelined overlaps reading batches from Postgres with loading them
+// into SingleStore. Up to depth extracted batches are queued while the current
+// batch is being committed. Batches are always committed in order, so the
+// checkpoint in replication_meta only ever moves forward. Every batch is
+// extracted with opts, with Prev set to the batch before it.
+//
+// It returns once stopCtx is cancelled and every queued batch has been
+// committed, or when either side fails. The returned height is where the next
+// batch should start, regardless of whether an error is returned.
+// ErrChainBroken is returned if the chain changed between two batches, in
+// which case the caller should restart from the returned height so the chain
+// is checked against SingleStore.
+func ReplicatePipelined(stopCtx context.Context, abortCtx context.Context, pgConn *sql.DB, sdbConn *sql.DB, height *big.Int, sizer *BatchSizer, depth int, pollInterval time.Duration, opts ExtractOptions) (*big.Int, error) {
+	ctx, cancel := context.WithCancel(abortCtx)
+	defer cancel()
+
+	queue := make(chan *PreparedBatch, depth)
+	extractErr := make(chan error, 1)
+	go func() {
+		defer close(queue)
+		extractErr <- extractBatches(stopCtx, ctx, pgConn, sdbConn, height, sizer, pollInterval, opts, queue)
+	}()
+
+	next := height
+	for batch := range queue {
+		start := time.Now()
+		err := batch.Commit(ctx)
+		if err != nil {
+			cancel()
+			batch.Abort()
+			// discard anything extracted after the failed batch
+			abortQueued(queue)
+			<-extractErr
+			return next, err
+		}
+
+		duration := batch.extractDuration + time.Since(start)
+		MetricBatchReplicationTime.Observe(duration.Seconds())
+		sizer.Observe(batch.Blocks, batch.Rows, duration)
+
+		next = (&big.Int{}).Add(batch.MaxBlockHeight, big.NewInt(1))
+	}
+
+	return next, <-extractErr
+}
+
+func extractBatches(stopCtx context.Context, ctx context.Context, pgConn *sql.DB, sdbConn *sql.DB, height *big.Int, sizer *BatchSizer, pollInterval time.Duration, opts ExtractOptions, queue chan<- *PreparedBatch) error {
+	for stopCtx.Err() == nil {
+		start := time.Now()
+		batch, err := Extract(ctx, pgConn, sdbConn, height, sizer.Limit(), opts)
+		if err != nil {
+			return err
+		}
+
+		if batch == nil {
+			// caught up, wait for more blocks
+			select {
+			case <-stopCtx.Done():
+			case <-ctx.Done():
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+		batch.extractDuration = time.Since(start)
+
+		select {
+		case queue <- batch:
+		case <-ctx.Done():
+			batch.Abort()
+			return ctx.Err()
+		}
+
+		opts.Prev = batch
+		opts.Stale = nil
+		height = (&big.Int{}).Add(batch.MaxBlockHeight, big.NewInt(1))
+	}
+	return nil
+}
+
+// abortQueued aborts every batch received from queue until it is closed.
+func abortQueued(queue <-chan *PreparedBatch) {
+	for batch := range queue {
+		batch.Abort()
+	}
+}
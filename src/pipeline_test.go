@@ -0,0 +1,236 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pipelineSink records committed batches like recordingSink. Every commit
+// waits for release, or for its context to be cancelled, and the commit of
+// the batch starting at failAt fails.
+type pipelineSink struct {
+	recordingSink
+	release chan struct{}
+	failAt  int64
+
+	// begun receives a value whenever a batch is begun
+	begun chan struct{}
+
+	mu      sync.Mutex
+	batches int
+	aborted int
+}
+
+func newPipelineSink(failAt int64) *pipelineSink {
+	return &pipelineSink{
+		release: make(chan struct{}),
+		failAt:  failAt,
+		begun:   make(chan struct{}, 100),
+	}
+}
+
+func (s *pipelineSink) Begin(tables *TableGraph) (SinkBatch, error) {
+	s.mu.Lock()
+	s.batches++
+	s.mu.Unlock()
+	s.begun <- struct{}{}
+	return &pipelineBatch{recordingBatch: recordingBatch{sink: &s.recordingSink}, pipeline: s}, nil
+}
+
+// counts returns the number of batches begun and aborted.
+func (s *pipelineSink) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches, s.aborted
+}
+
+// waitForBatches waits until n batches have been begun.
+func (s *pipelineSink) waitForBatches(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-s.begun:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d batches were begun", i)
+		}
+	}
+}
+
+type pipelineBatch struct {
+	recordingBatch
+	pipeline *pipelineSink
+}
+
+func (b *pipelineBatch) Commit(ctx context.Context, startHeight *big.Int, endHeight *big.Int) error {
+	select {
+	case <-b.pipeline.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if startHeight.Int64() == b.pipeline.failAt {
+		return errors.Errorf("failed to commit %s", startHeight)
+	}
+	return b.recordingBatch.Commit(ctx, startHeight, endHeight)
+}
+
+func (b *pipelineBatch) Abort() error {
+	b.pipeline.mu.Lock()
+	defer b.pipeline.mu.Unlock()
+	b.pipeline.aborted++
+	return nil
+}
+
+// chainDB returns a fake Postgres with a chain of blocks from 1 to tip, where
+// the hash of every block is its height.
+func chainDB(t *testing.T, tip int64) *sql.DB {
+	pgConn, _ := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+		switch {
+		case query == "select pg_export_snapshot()":
+			return []string{"pg_export_snapshot"}, [][]string{{"00000003-1"}}, nil
+		case strings.HasPrefix(query, "select count(*) from blocks"):
+			base, _ := strconv.ParseInt(args[0].(string), 10, 64)
+			count := tip - base + 1
+			if count < 0 {
+				count = 0
+			}
+			return []string{"count"}, [][]string{{fmt.Sprint(count)}}, nil
+		case strings.HasPrefix(query, "select * from blocks"):
+			base, _ := strconv.ParseInt(args[0].(string), 10, 64)
+			limit, _ := strconv.ParseInt(fmt.Sprint(args[len(args)-1]), 10, 64)
+			var rows [][]string
+			for h := base; h <= tip && h < base+limit; h++ {
+				rows = append(rows, []string{fmt.Sprint(h), fmt.Sprint(h), fmt.Sprint(h - 1)})
+			}
+			return []string{"block_height", "block_hash", "prev_block_hash"}, rows, nil
+		}
+		return nil, nil, nil
+	})
+	return pgConn
+}
+
+func pipelineOptions(t *testing.T, sink Sink) ExtractOptions {
+	tables, err := DefaultTableGraph.Select([]string{RootTable}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ExtractOptions{SkipChainCheck: true, Tables: tables, Sink: sink}
+}
+
+type pipelineResult struct {
+	next *big.Int
+	err  error
+}
+
+// startPipeline runs ReplicatePipelined from height 1 with batches of two
+// blocks and two queued batches.
+func startPipeline(t *testing.T, stopCtx context.Context, abortCtx context.Context, sink *pipelineSink) <-chan pipelineResult {
+	sizer, err := NewBatchSizer(2, 1, 2, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pgConn := chainDB(t, 10)
+	opts := pipelineOptions(t, sink)
+	done := make(chan pipelineResult, 1)
+	go func() {
+		next, err := ReplicatePipelined(stopCtx, abortCtx, pgConn, nil, big.NewInt(1), sizer, 2, time.Millisecond, opts)
+		done <- pipelineResult{next, err}
+	}()
+	return done
+}
+
+func waitForPipeline(t *testing.T, done <-chan pipelineResult) pipelineResult {
+	t.Helper()
+	select {
+	case result := <-done:
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReplicatePipelined did not return")
+	}
+	return pipelineResult{}
+}
+
+func TestReplicatePipelinedDrainsInOrderWhenStopped(t *testing.T) {
+	stopCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	sink := newPipelineSink(-1)
+	done := startPipeline(t, stopCtx, context.Background(), sink)
+
+	// one batch is being committed, two are queued and the fourth is waiting
+	// for room in the queue
+	sink.waitForBatches(t, 4)
+	stop()
+	close(sink.release)
+
+	result := waitForPipeline(t, done)
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if result.next.Int64() != 9 {
+		t.Errorf("next height = %s, want 9", result.next)
+	}
+	want := []string{"commit 1-2 [blocks:1 blocks:2]", "commit 3-4 [blocks:3 blocks:4]", "commit 5-6 [blocks:5 blocks:6]", "commit 7-8 [blocks:7 blocks:8]"}
+	if !reflect.DeepEqual(sink.events, want) {
+		t.Errorf("committed %v, want %v", sink.events, want)
+	}
+	if batches, aborted := sink.counts(); batches != 4 || aborted != 0 {
+		t.Errorf("began %d batches and aborted %d, want 4 and none", batches, aborted)
+	}
+}
+
+func TestReplicatePipelinedAbortsQueuedBatchesAfterCommitFailure(t *testing.T) {
+	sink := newPipelineSink(3)
+	done := startPipeline(t, context.Background(), context.Background(), sink)
+
+	sink.waitForBatches(t, 4)
+	close(sink.release)
+
+	result := waitForPipeline(t, done)
+	if result.err == nil || !strings.Contains(result.err.Error(), "failed to commit 3") {
+		t.Errorf("got error %v, want the commit failure", result.err)
+	}
+	if result.next.Int64() != 3 {
+		t.Errorf("next height = %s, want 3", result.next)
+	}
+	if want := []string{"commit 1-2 [blocks:1 blocks:2]"}; !reflect.DeepEqual(sink.events, want) {
+		t.Errorf("committed %v, want %v", sink.events, want)
+	}
+	// every batch but the committed one is aborted, including the failed one
+	if batches, aborted := sink.counts(); aborted != batches-1 {
+		t.Errorf("began %d batches and aborted %d, want all but one aborted", batches, aborted)
+	}
+}
+
+func TestReplicatePipelinedAbortsBlockedExtractor(t *testing.T) {
+	abortCtx, abort := context.WithCancel(context.Background())
+	defer abort()
+	sink := newPipelineSink(-1)
+	done := startPipeline(t, context.Background(), abortCtx, sink)
+
+	sink.waitForBatches(t, 4)
+	abort()
+
+	result := waitForPipeline(t, done)
+	if !errors.Is(result.err, context.Canceled) {
+		t.Errorf("got error %v, want %v", result.err, context.Canceled)
+	}
+	if result.next.Int64() != 1 {
+		t.Errorf("next height = %s, want 1", result.next)
+	}
+	if len(sink.events) != 0 {
+		t.Errorf("committed %v", sink.events)
+	}
+	if batches, aborted := sink.counts(); aborted != batches {
+		t.Errorf("began %d batches and aborted %d, want all aborted", batches, aborted)
+	}
+}
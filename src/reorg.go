@@ -0,0 +1,362 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/big"
+	"reflect"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// maxReorgDepth bounds how far back we will search SingleStore for a block
+// which is still part of the canonical chain in Postgres.
+const maxReorgDepth = 1000
+
+// ReorgError is returned by Replicate when the next batch of blocks does not
+// extend the chain already replicated to SingleStore. By the time this error
+// is returned SingleStore has been rewound to AncestorHeight, so replication
+// should resume at AncestorHeight + 1 with Stale set in ExtractOptions.
+type ReorgError struct {
+	ForkHeight     *big.Int
+	AncestorHeight *big.Int
+
+	// Stale has the keys of the rows of tables updated in place which were
+	// last updated above AncestorHeight, by table, as returned by
+	// ReadStaleKeys.
+	Stale map[string][][]string
+}
+
+func (e *ReorgError) Error() string {
+	return fmt.Sprintf("chain reorganization detected at height %s; rewound to common ancestor at height %s", e.ForkHeight, e.AncestorHeight)
+}
+
+const (
+	orphanedBlocks   = "SELECT block_hash FROM blocks WHERE block_height > ?"
+	orphanedReceipts = "SELECT receipt_id FROM receipts WHERE included_in_block_hash IN (" + orphanedBlocks + ")"
+	orphanedTxns     = "SELECT transaction_hash FROM transactions WHERE included_in_block_hash IN (" + orphanedBlocks + ")"
+)
+
+// rewindQueries deletes every row which was replicated from a block above the
+// height passed as the only query argument. Tables which are looked up via
+// receipts or transactions must be rewound before their parents. Tables
+// updated in place are in staleQueries instead.
+var rewindQueries = []struct {
+	table string
+	query string
+}{
+	{"transaction_actions", "DELETE FROM transaction_actions WHERE transaction_hash IN (" + orphanedTxns + ")"},
+	{"action_receipt_actions", "DELETE FROM action_receipt_actions WHERE receipt_id IN (" + orphanedReceipts + ")"},
+	{"action_receipt_input_data", "DELETE FROM action_receipt_input_data WHERE input_to_receipt_id IN (" + orphanedReceipts + ")"},
+	{"action_receipt_output_data", "DELETE FROM action_receipt_output_data WHERE output_from_receipt_id IN (" + orphanedReceipts + ")"},
+	{"action_receipts", "DELETE FROM action_receipts WHERE receipt_id IN (" + orphanedReceipts + ")"},
+	{"data_receipts", "DELETE FROM data_receipts WHERE receipt_id IN (" + orphanedReceipts + ")"},
+	{"execution_outcome_receipts", "DELETE FROM execution_outcome_receipts WHERE executed_receipt_id IN (" + orphanedReceipts + ")"},
+	{"account_changes", "DELETE FROM account_changes WHERE changed_in_block_hash IN (" + orphanedBlocks + ")"},
+	{"chunks", "DELETE FROM chunks WHERE included_in_block_hash IN (" + orphanedBlocks + ")"},
+	{"execution_outcomes", "DELETE FROM execution_outcomes WHERE executed_in_block_hash IN (" + orphanedBlocks + ")"},
+	{"receipts", "DELETE FROM receipts WHERE included_in_block_hash IN (" + orphanedBlocks + ")"},
+	{"transactions", "DELETE FROM transactions WHERE included_in_block_hash IN (" + orphanedBlocks + ")"},
+	{"blocks", "DELETE FROM blocks WHERE block_height > ?"},
+}
+
+// staleQueries select the keys of the rows of tables which are updated in
+// place whose last update was in a block above the height passed to
+// sdbQuery. These rows can not be deleted by a rewind, since they existed
+// before the fork and an older version of them is still canonical, so they
+// are read again from Postgres by key with pgQuery instead. Keys are in the
+// order of deleteKeys, and pgQuery is passed one array per key column.
+var staleQueries = []struct {
+	table    string
+	sdbQuery string
+	pgQuery  string
+}{
+	{
+		"accounts",
+		"SELECT id FROM accounts WHERE last_update_block_height > ?",
+		"select * from accounts where id = ANY($1::bigint[])",
+	},
+	{
+		"access_keys",
+		"SELECT public_key, account_id FROM access_keys WHERE last_update_block_height > ?",
+		"select * from access_keys where (public_key, account_id) in (select * from unnest($1::text[], $2::text[]))",
+	},
+}
+
+func init() {
+	rewound := make(map[string]bool)
+	for _, q := range rewindQueries {
+		rewound[q.table] = true
+	}
+	for _, q := range staleQueries {
+		rewound[q.table] = true
+	}
+	for _, model := range Models {
+		if !rewound[model.Table] {
+			panic(fmt.Sprintf("table %s has no rewind query", model.Table))
+		}
+	}
+}
+
+type replicatedBlock struct {
+	height string
+	hash   string
+}
+
+// readReplicatedBlocks returns up to limit blocks from SingleStore below the
+// provided height in descending order.
+func readReplicatedBlocks(ctx context.Context, sdbConn *sql.DB, belowHeight *big.Int, limit int) ([]replicatedBlock, error) {
+	rows, err := sdbConn.QueryContext(ctx, "SELECT block_height, block_hash FROM blocks WHERE block_height < ? ORDER BY block_height DESC LIMIT ?", belowHeight.String(), limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read replicated blocks")
+	}
+	defer rows.Close()
+
+	out := make([]replicatedBlock, 0, limit)
+	for rows.Next() {
+		var b replicatedBlock
+		err = rows.Scan(&b.height, &b.hash)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan replicated block")
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+// readCanonicalHashes returns the subset of hashes which exist in Postgres.
+func readCanonicalHashes(ctx context.Context, pgConn *sql.DB, hashes []string) (map[string]bool, error) {
+	rows, err := pgConn.QueryContext(ctx, "select block_hash from blocks where block_hash = ANY($1)", pq.Array(hashes))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read canonical blocks")
+	}
+	defer rows.Close()
+
+	out := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan canonical block")
+		}
+		out[hash] = true
+	}
+	return out, rows.Err()
+}
+
+// verifyBatchChain checks that blocks form a contiguous hash chain.
+func verifyBatchChain(blocks []*Block) error {
+	for i := 1; i < len(blocks); i++ {
+		if blocks[i].PrevBlockHash != blocks[i-1].BlockHash {
+			return errors.Errorf("postgres returned a broken chain at height %s: prev_block_hash %s does not match block_hash %s",
+				blocks[i].Height(), blocks[i].PrevBlockHash, blocks[i-1].BlockHash)
+		}
+	}
+	return nil
+}
+
+// verifyChain checks that the first block extends the last block replicated
+// to SingleStore. If the chain in SingleStore has been orphaned SingleStore is
+// rewound to the common ancestor and a *ReorgError is returned, along with the
+// keys of the stale rows of the tables loaded by tables. The rewind is
+// recorded in sink first if it keeps a record of rewinds.
+func verifyChain(ctx context.Context, pgConn *sql.DB, sdbConn *sql.DB, sink Sink, tables *TableGraph, blocks []*Block) error {
+	first := blocks[0]
+	firstHeight := first.Height()
+	last, err := readReplicatedBlocks(ctx, sdbConn, firstHeight, 1)
+	if err != nil {
+		return err
+	}
+	if len(last) == 0 || last[0].hash == first.PrevBlockHash {
+		return nil
+	}
+
+	canonical, err := readCanonicalHashes(ctx, pgConn, []string{last[0].hash})
+	if err != nil {
+		return err
+	}
+	if canonical[last[0].hash] {
+		// the last replicated block is still canonical, we are just not
+		// replicating from the block right after it (i.e. --start-height)
+		log.Printf("block at height %s does not follow replicated block at height %s; skipping blocks in between",
+			firstHeight, last[0].height)
+		return nil
+	}
+
+	ancestorHeight, err := findCommonAncestor(ctx, pgConn, sdbConn, firstHeight)
+	if err != nil {
+		return err
+	}
+	stale, err := ReadStaleKeys(ctx, sdbConn, tables, ancestorHeight)
+	if err != nil {
+		return err
+	}
+
+	if recorder, ok := sink.(rewindRecorder); ok {
+		err = recorder.RecordRewind(ancestorHeight)
+		if err != nil {
+			return errors.Wrap(err, "failed to record rewind")
+		}
+	}
+	err = Rewind(ctx, sdbConn, tables, ancestorHeight)
+	if err != nil {
+		return err
+	}
+
+	MetricReorgs.Inc()
+	return &ReorgError{ForkHeight: ParseBigInt(last[0].height), AncestorHeight: ancestorHeight, Stale: stale}
+}
+
+// ReadStaleKeys returns the keys of the rows of tables updated in place which
+// are loaded by tables and were last updated above height, by table. After a
+// rewind to height these rows may hold versions from orphaned blocks until
+// they are read again from Postgres, so they should be passed as Stale to
+// the next batch. There are none while SingleStore is only replicated in
+// order up to height.
+func ReadStaleKeys(ctx context.Context, sdbConn *sql.DB, tables *TableGraph, height *big.Int) (map[string][][]string, error) {
+	out := make(map[string][][]string)
+	for _, q := range staleQueries {
+		if !tables.Loads(q.table) {
+			continue
+		}
+		keys, err := readKeys(ctx, sdbConn, q.sdbQuery, height.String())
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read stale keys from %s", q.table)
+		}
+		if len(keys) > 0 {
+			out[q.table] = keys
+		}
+	}
+	return out, nil
+}
+
+// rereadStale writes the current version in Postgres of every row in stale to
+// loader, and deletes the ones which no longer exist.
+func rereadStale(ctx context.Context, db querier, loader *Loader, tables *TableGraph, accounts *AccountFilter, stale map[string][][]string) error {
+	for _, q := range staleQueries {
+		keys := stale[q.table]
+		if len(keys) == 0 || !tables.Loads(q.table) {
+			continue
+		}
+		model := loader.tables[q.table].model
+		keyFields := deleteKeys[q.table]
+
+		rows := make([]Model, 0, len(keys))
+		columns := make([][]string, len(keyFields))
+		for _, key := range keys {
+			row := model.New()
+			v := reflect.ValueOf(row).Elem()
+			for i, field := range keyFields {
+				err := setField(v.FieldByName(field), key[i])
+				if err != nil {
+					return errors.Wrapf(err, "failed to read stale key of %s", q.table)
+				}
+				columns[i] = append(columns[i], key[i])
+			}
+			rows = append(rows, row)
+		}
+		args := make([]interface{}, 0, len(columns))
+		for _, column := range columns {
+			args = append(args, pq.Array(column))
+		}
+
+		written, err := extractTable(ctx, db, loader, model, true, true, accounts, q.pgQuery, args...)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read stale rows of %s", q.table)
+		}
+		exists := make(map[string]bool, len(written))
+		for _, key := range written {
+			exists[key] = true
+		}
+		for _, row := range rows {
+			if exists[row.Key()] {
+				continue
+			}
+			err = loader.Delete(q.table, row)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findCommonAncestor walks backwards through the blocks replicated to
+// SingleStore below the provided height and returns the height of the first
+// one which is still part of the chain in Postgres.
+func findCommonAncestor(ctx context.Context, pgConn *sql.DB, sdbConn *sql.DB, belowHeight *big.Int) (*big.Int, error) {
+	const pageSize = 100
+
+	height := belowHeight
+	for searched := 0; searched < maxReorgDepth; searched += pageSize {
+		blocks, err := readReplicatedBlocks(ctx, sdbConn, height, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(blocks) == 0 {
+			break
+		}
+
+		hashes := make([]string, len(blocks))
+		for i, b := range blocks {
+			hashes[i] = b.hash
+		}
+		canonical, err := readCanonicalHashes(ctx, pgConn, hashes)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, b := range blocks {
+			if canonical[b.hash] {
+				return ParseBigInt(b.height), nil
+			}
+		}
+
+		height = ParseBigInt(blocks[len(blocks)-1].height)
+	}
+
+	return nil, errors.Errorf("unable to find a common ancestor within %d blocks below height %s", maxReorgDepth, belowHeight)
+}
+
+// Rewind deletes every row of the tables loaded by tables which was
+// replicated above the provided height from SingleStore and trims
+// replication_meta so that no range extends past it. Rows of tables whose
+// parents are not loaded can not be matched to blocks in SingleStore, so they
+// are left in place.
+func Rewind(ctx context.Context, sdbConn *sql.DB, tables *TableGraph, height *big.Int) error {
+	tx, err := sdbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to start rewind transaction")
+	}
+	defer tx.Rollback()
+
+	for _, q := range rewindQueries {
+		if !tables.Loads(q.table) {
+			continue
+		}
+		if !tables.LoadsWithParents(q.table) {
+			log.Printf("not rewinding %s since the tables it is joined through are not replicated; rows from orphaned blocks are left in it", q.table)
+			continue
+		}
+		_, err = tx.ExecContext(ctx, q.query, height.String())
+		if err != nil {
+			return errors.Wrapf(err, "failed to rewind %s", q.table)
+		}
+	}
+
+	// keep the part of a range which started at or below the ancestor
+	h := height.String()
+	_, err = tx.ExecContext(ctx, "REPLACE INTO replication_meta (start_height, block_height) SELECT start_height, ? FROM replication_meta WHERE start_height <= ? AND block_height > ?", h, h, h)
+	if err != nil {
+		return errors.Wrap(err, "failed to rewind replication_meta")
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM replication_meta WHERE block_height > ?", h)
+	if err != nil {
+		return errors.Wrap(err, "failed to rewind replication_meta")
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to commit rewind")
+}
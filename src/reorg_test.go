@@ -0,0 +1,219 @@
+package src
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVerifyBatchChain(t *testing.T) {
+	chain := []*Block{
+		{BlockHash: "a", PrevBlockHash: "z"},
+		{BlockHash: "b", PrevBlockHash: "a"},
+		{BlockHash: "c", PrevBlockHash: "b"},
+	}
+	if err := verifyBatchChain(chain); err != nil {
+		t.Errorf("unexpected error for a contiguous chain: %v", err)
+	}
+	if err := verifyBatchChain(chain[:1]); err != nil {
+		t.Errorf("unexpected error for a single block: %v", err)
+	}
+
+	broken := []*Block{
+		{BlockHash: "a", PrevBlockHash: "z"},
+		{BlockHash: "c", PrevBlockHash: "b"},
+	}
+	if err := verifyBatchChain(broken); err == nil {
+		t.Error("expected an error for a broken chain")
+	}
+}
+
+// findTestAncestor runs findCommonAncestor above a SingleStore with a block at
+// every height from 1 to replicated, hashed "s<height>", and a Postgres which
+// only has the hashes in canonical. It returns the ancestor or the error.
+func findTestAncestor(t *testing.T, replicated int, canonical map[string]bool) (string, string) {
+	sdbConn, _ := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+		if !strings.HasPrefix(query, "SELECT block_height, block_hash FROM blocks") {
+			return nil, nil, nil
+		}
+		var below, limit int
+		fmt.Sscan(args[0].(string), &below)
+		limit = int(args[1].(int64))
+		rows := make([][]string, 0)
+		for h := below - 1; h > 0 && h <= replicated && len(rows) < limit; h-- {
+			rows = append(rows, []string{fmt.Sprint(h), fmt.Sprintf("s%d", h)})
+		}
+		return []string{"block_height", "block_hash"}, rows, nil
+	})
+	pgConn, _ := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+		rows := make([][]string, 0)
+		hashes := strings.Split(strings.Trim(args[0].(string), "{}"), ",")
+		for _, hash := range hashes {
+			if canonical[strings.Trim(hash, `"`)] {
+				rows = append(rows, []string{strings.Trim(hash, `"`)})
+			}
+		}
+		return []string{"block_hash"}, rows, nil
+	})
+	ancestor, err := findCommonAncestor(context.Background(), pgConn, sdbConn, big.NewInt(int64(replicated+1)))
+	if err != nil {
+		return "", err.Error()
+	}
+	return ancestor.String(), ""
+}
+
+func TestFindCommonAncestor(t *testing.T) {
+	canonical := make(map[string]bool)
+	for h := 1; h <= 250; h++ {
+		canonical[fmt.Sprintf("s%d", h)] = true
+	}
+
+	tests := []struct {
+		name       string
+		replicated int
+		want       string
+		err        string
+	}{
+		{"fork in the first page", 260, "250", ""},
+		{"fork after several pages", 480, "250", ""},
+		{"no fork", 250, "250", ""},
+		{"too deep", 1300, "", "unable to find a common ancestor within 1000 blocks"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := findTestAncestor(t, tt.replicated, canonical)
+			if tt.err != "" {
+				if !strings.Contains(err, tt.err) {
+					t.Fatalf("got error %q, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != "" {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ancestor = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// nothing in common with postgres
+	if _, err := findTestAncestor(t, 50, map[string]bool{}); !strings.Contains(err, "unable to find a common ancestor") {
+		t.Errorf("got error %q for disjoint chains", err)
+	}
+}
+
+func TestReadStaleKeys(t *testing.T) {
+	sdbConn, sdb := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT id FROM accounts"):
+			return []string{"id"}, [][]string{{"1"}, {"2"}}, nil
+		case strings.HasPrefix(query, "SELECT public_key, account_id FROM access_keys"):
+			return []string{"public_key", "account_id"}, [][]string{}, nil
+		}
+		return nil, nil, nil
+	})
+
+	stale, err := ReadStaleKeys(context.Background(), sdbConn, DefaultTableGraph, big.NewInt(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][][]string{"accounts": {{"1"}, {"2"}}}
+	if !reflect.DeepEqual(stale, want) {
+		t.Errorf("stale = %v, want %v", stale, want)
+	}
+	for _, stmt := range sdb.Statements() {
+		if !strings.HasSuffix(stmt, "> ?") {
+			t.Errorf("unexpected statement %q", stmt)
+		}
+	}
+
+	// tables which are not loaded are not read
+	tables, err := DefaultTableGraph.Select(nil, []string{"accounts", "access_keys"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(sdb.Statements())
+	stale, err = ReadStaleKeys(context.Background(), sdbConn, tables, big.NewInt(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 0 || len(sdb.Statements()) != before {
+		t.Errorf("read stale keys of tables which are not loaded: %v", stale)
+	}
+}
+
+func TestRereadStale(t *testing.T) {
+	pgConn, _ := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+		if !strings.HasPrefix(query, "select * from accounts") {
+			return nil, nil, nil
+		}
+		if args[0] != `{"1","2","3"}` {
+			return nil, nil, fmt.Errorf("unexpected keys %v", args[0])
+		}
+		// account 2 has been deleted since
+		return []string{"id", "account_id", "last_update_block_height"}, [][]string{
+			{"1", "alice.near", "90"},
+			{"3", "carol.near", "120"},
+		}, nil
+	})
+
+	sink := &recordingSink{}
+	loader, err := NewLoader(sink, DefaultTableGraph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := map[string][][]string{"accounts": {{"1"}, {"2"}, {"3"}}}
+	err = rereadStale(context.Background(), pgConn, loader, DefaultTableGraph, nil, stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loader.Commit(context.Background(), big.NewInt(101), big.NewInt(110))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"commit 101-110 [accounts:1 accounts:3 delete accounts:2]"}
+	if !reflect.DeepEqual(sink.events, want) {
+		t.Errorf("events = %v, want %v", sink.events, want)
+	}
+}
+
+func TestRewindTables(t *testing.T) {
+	sdbConn, sdb := openFakeDB(t, nil)
+	tables, err := DefaultTableGraph.Select(nil, []string{"transactions", "receipts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Rewind(context.Background(), sdbConn, tables, big.NewInt(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewound := make(map[string]bool)
+	for _, stmt := range sdb.Statements() {
+		if strings.HasPrefix(stmt, "DELETE FROM ") {
+			rewound[strings.Fields(stmt)[2]] = true
+		}
+	}
+	for _, q := range rewindQueries {
+		want := tables.LoadsWithParents(q.table)
+		if rewound[q.table] != want {
+			t.Errorf("rewound %s: %v, want %v", q.table, rewound[q.table], want)
+		}
+	}
+	for _, table := range []string{"blocks", "chunks", "replication_meta"} {
+		if !rewound[table] {
+			t.Errorf("%s was not rewound", table)
+		}
+	}
+	for _, table := range []string{"transactions", "transaction_actions", "action_receipts"} {
+		if rewound[table] {
+			t.Errorf("%s was rewound", table)
+		}
+	}
+}
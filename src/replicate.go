@@ -1,19 +1,18 @@
 package src
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"math/big"
 	"time"
 
-	"github.com/georgysavva/scany/sqlscan"
-	"github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
-func readMaxBlockHeightFromTable(db *sql.DB, tableName string) (*big.Int, error) {
-	row := db.QueryRow(fmt.Sprintf("SELECT coalesce(MAX(block_height), 0) FROM %s", tableName))
+func readMaxBlockHeightFromTable(db querier, tableName string) (*big.Int, error) {
+	row := db.QueryRowContext(context.Background(), fmt.Sprintf("SELECT coalesce(MAX(block_height), 0) FROM %s", tableName))
 	var height string
 	err := row.Scan(&height)
 	if err != nil {
@@ -26,11 +25,23 @@ func ReadMaxReplicatedBlockHeight(db *sql.DB) (*big.Int, error) {
 	return readMaxBlockHeightFromTable(db, "replication_meta")
 }
 
-func ReadMaxBlockHeight(db *sql.DB) (*big.Int, error) {
+// ReadMinReplicatedBlockHeight returns the lowest block height replicated to
+// SingleStore. Ranges without a start_height cover every block below them.
+func ReadMinReplicatedBlockHeight(db *sql.DB) (*big.Int, error) {
+	row := db.QueryRowContext(context.Background(), "SELECT coalesce(MIN(coalesce(start_height, 0)), 0) FROM replication_meta")
+	var height string
+	err := row.Scan(&height)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query lowest replicated block")
+	}
+	return ParseBigInt(height), nil
+}
+
+func ReadMaxBlockHeight(db querier) (*big.Int, error) {
 	return readMaxBlockHeightFromTable(db, "blocks")
 }
 
-func MonitorBlockHeights(pgConn *sql.DB, sdbConn *sql.DB, pollInterval time.Duration) {
+func MonitorBlockHeights(ctx context.Context, pgConn *sql.DB, sdbConn *sql.DB, pollInterval time.Duration) {
 	var (
 		pgHeight  *big.Int
 		sdbHeight *big.Int
@@ -41,14 +52,22 @@ func MonitorBlockHeights(pgConn *sql.DB, sdbConn *sql.DB, pollInterval time.Dura
 	)
 
 	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+
 		pgHeight, err = ReadMaxBlockHeight(pgConn)
 		if err != nil {
 			log.Printf("failed to read from postgres: %+v", err)
+			continue
 		}
 
 		sdbHeight, err = ReadMaxReplicatedBlockHeight(sdbConn)
 		if err != nil {
 			log.Printf("failed to read from singlestore: %+v", err)
+			continue
 		}
 
 		// this will stop working once height > 2^63-1
@@ -59,159 +78,442 @@ func MonitorBlockHeights(pgConn *sql.DB, sdbConn *sql.DB, pollInterval time.Dura
 		// track lag for convenience
 		lag := (&big.Int{}).Sub(pgHeight, sdbHeight).Int64()
 		MetricBlockLag.Set(float64(lag))
-
-		time.Sleep(pollInterval)
 	}
 }
 
-func WriteReplicatedBlockHeight(db *sql.DB, block_height *big.Int) error {
-	_, err := db.Exec("REPLACE INTO replication_meta VALUES (?)", block_height.String())
-	return errors.Wrap(err, "failed to save replicated block height")
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
 }
 
-func Replicate(pgConn *sql.DB, sdbConn *sql.DB, baseHeight *big.Int, limit int) (*big.Int, error) {
-	rowCount := pgConn.QueryRow("select count(*) from blocks where block_height >= $1", baseHeight.String())
-	var blockCount int64
-	err := rowCount.Scan(&blockCount)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to read count from row")
-	}
-	if blockCount == 0 {
-		return nil, nil
+// WriteReplicatedRange records that every block between startHeight and
+// endHeight (inclusive) has been replicated.
+func WriteReplicatedRange(db execer, startHeight *big.Int, endHeight *big.Int) error {
+	_, err := db.Exec("REPLACE INTO replication_meta (start_height, block_height) VALUES (?, ?)", startHeight.String(), endHeight.String())
+	return errors.Wrap(err, "failed to save replicated block range")
+}
+
+// Batch describes a range of blocks committed to SingleStore by Replicate.
+type Batch struct {
+	// StartHeight is the height the batch was requested from. Heights between
+	// StartHeight and the first block in the batch were skipped by the chain.
+	StartHeight    *big.Int
+	MaxBlockHeight *big.Int
+	Blocks         int
+	Rows           int
+}
+
+// PreparedBatch is a batch which has been read from Postgres and written to
+// a sink but not yet committed.
+type PreparedBatch struct {
+	Batch
+
+	loader          *Loader
+	lastBlockHash   string
+	extractDuration time.Duration
+	skipCheckpoint  bool
+}
+
+// Stats returns the rows in the batch for each table.
+func (b *PreparedBatch) Stats() []TableStats {
+	return b.loader.Stats()
+}
+
+// Commit commits the batch to its sink along with its checkpoint.
+func (b *PreparedBatch) Commit(ctx context.Context) error {
+	endHeight := b.MaxBlockHeight
+	if b.skipCheckpoint {
+		endHeight = nil
 	}
+	return errors.Wrap(b.loader.Commit(ctx, b.StartHeight, endHeight), "failed to commit the load")
+}
 
-	loader := NewLoader(sdbConn)
+// Abort discards a batch which will not be committed.
+func (b *PreparedBatch) Abort() error {
+	return b.loader.Abort()
+}
 
-	err = loader.Touch("blocks")
-	if err != nil {
+// ErrChainBroken is returned by Extract when the next batch does not extend
+// the previously extracted batch. Any batches extracted earlier should be
+// committed before extracting again without a previous batch, which will
+// check the chain against SingleStore instead.
+var ErrChainBroken = errors.New("next batch does not extend the previous batch")
+
+// ExtractOptions controls which blocks Extract reads and how they are checked.
+type ExtractOptions struct {
+	// EndHeight is the highest block height to extract, or nil for no bound.
+	EndHeight *big.Int
+
+	// Prev is the previously extracted batch. If set, the first block must
+	// extend it.
+	Prev *PreparedBatch
+
+	// SkipChainCheck disables checking the first block against the last block
+	// in SingleStore when Prev is nil. This is used when replicating ranges
+	// out of order.
+	SkipChainCheck bool
+
+	// SkipCheckpoint commits the batch without recording it in
+	// replication_meta, so that re-replicating a range of blocks does not
+	// move the checkpoint. Used with SkipChainCheck.
+	SkipCheckpoint bool
+
+	// ConfirmationDepth is the number of blocks below the Postgres head which
+	// may still change. Blocks within it are not extracted unless Optimistic
+	// is set.
+	ConfirmationDepth int64
+
+	// Optimistic extracts blocks within ConfirmationDepth of the Postgres
+	// head with Finalized unset. Every batch marks the blocks which have since
+	// become final as finalized.
+	Optimistic bool
+
+	// MutableLookback also reads accounts and access_keys updated up to this
+	// many blocks before baseHeight. This catches updates which the indexer
+	// writes after the block they belong to, at the cost of re-reading rows
+	// which have not changed.
+	MutableLookback int64
+
+	// ReconcileDeletes deletes rows from accounts, access_keys and
+	// account_changes which belong to the batch in SingleStore but no longer
+	// exist in Postgres.
+	ReconcileDeletes bool
+
+	// Tables is the graph of tables to replicate, or nil for every table.
+	Tables *TableGraph
+
+	// DryRun reads and encodes the batch without touching SingleStore. The
+	// chain is not checked against SingleStore and deletes are not
+	// reconciled, and the batch can not be committed.
+	DryRun bool
+
+	// Sink receives every batch, or nil to load them into SingleStore. The
+	// chain check and ReconcileDeletes read SingleStore regardless, so they
+	// should be disabled for other sinks.
+	Sink Sink
+
+	// Accounts limits transactions, receipts and execution outcomes, along
+	// with the tables which depend on them, to the activity of the matching
+	// accounts. A nil filter replicates every account.
+	Accounts *AccountFilter
+
+	// Stale has the keys of rows of accounts and access_keys which may hold
+	// versions from orphaned blocks, as returned in ReorgError. The batch
+	// reads them again from Postgres and deletes the ones which no longer
+	// exist.
+	Stale map[string][][]string
+
+	// MaxBytes caps the size of a batch once encoded by a sink which reports
+	// it, such as SingleStoreSink, which holds the batch in memory until it
+	// is committed. A batch above it is extracted again with half as many
+	// blocks; a single block above it fails. 0 disables the limit.
+	MaxBytes int64
+}
+
+// BatchTooLargeError is returned by Extract when a single block is larger
+// than ExtractOptions.MaxBytes once encoded.
+type BatchTooLargeError struct {
+	Blocks   int
+	MaxBytes int64
+}
+
+func (e *BatchTooLargeError) Error() string {
+	return fmt.Sprintf("batch of %d blocks is larger than %d bytes", e.Blocks, e.MaxBytes)
+}
+
+func Replicate(ctx context.Context, pgConn *sql.DB, sdbConn *sql.DB, baseHeight *big.Int, limit int, opts ExtractOptions) (*Batch, error) {
+	batch, err := Extract(ctx, pgConn, sdbConn, baseHeight, limit, opts)
+	if err != nil || batch == nil {
 		return nil, err
 	}
 
-	rows, err := pgConn.Query("select * from blocks where block_height >= $1 order by block_height asc limit $2", baseHeight.String(), limit)
+	err = batch.Commit(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to read blocks")
+		return nil, err
 	}
 
-	scanner := sqlscan.NewRowScanner(rows)
-	blockHashes := make([]string, 0)
-	var maxBlockHeight string
-	dst := &Block{}
-	for rows.Next() {
-		err := scanner.Scan(dst)
+	return &batch.Batch, nil
+}
+
+// ReplicateRange replicates every block between startHeight and endHeight
+// (inclusive) in batches of up to limit blocks, without checking the chain
+// against the blocks already in SingleStore. Batches are extracted with
+// opts, apart from the options which control the range and the chain check.
+// It returns the height following the last committed batch, so that an
+// interrupted or failed range can be resumed from it, and false if stopCtx
+// was cancelled before the whole range was replicated.
+func ReplicateRange(stopCtx context.Context, ctx context.Context, pgConn *sql.DB, sdbConn *sql.DB, startHeight *big.Int, endHeight *big.Int, limit int, opts ExtractOptions) (*big.Int, bool, error) {
+	if limit < 1 {
+		// extract would find no blocks and the range would be recorded as
+		// replicated without loading anything
+		return startHeight, false, errors.Errorf("batch size %d must be positive", limit)
+	}
+	height := startHeight
+	opts.EndHeight = endHeight
+	opts.Prev = nil
+	opts.SkipChainCheck = true
+	var skippedEnd *big.Int
+	for {
+		if stopCtx.Err() != nil {
+			return height, false, nil
+		}
+
+		batch, emptyEnd, err := extract(ctx, pgConn, sdbConn, height, limit, opts)
+		if errors.Is(err, ErrChainBroken) {
+			opts.Prev = nil
+			continue
+		}
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to scan into &Block{}")
+			return height, false, err
 		}
-		err = loader.WriteRow("blocks", dst)
+		if batch == nil {
+			skippedEnd = emptyEnd
+			break
+		}
+
+		err = batch.Commit(ctx)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to write row to loader")
+			return height, false, err
 		}
-		blockHashes = append(blockHashes, dst.Key())
-		maxBlockHeight = dst.BlockHeight
-		MetricReplicatedRows.Inc()
-		MetricReplicatedBlocks.Inc()
+
+		opts.Prev = batch
+		height = (&big.Int{}).Add(batch.MaxBlockHeight, big.NewInt(1))
 	}
 
-	MetricBatchSize.Set(float64(len(blockHashes)))
+	if opts.SkipCheckpoint {
+		return height, true, nil
+	}
 
-	simpleReplicate := func(collectKeys bool, table string, dst Model, query string, args ...interface{}) ([]string, error) {
-		err := loader.Touch(table)
+	// the chain may have skipped the heights at the end of the range, record
+	// them as replicated so they are not mistaken for a gap. Only the heights
+	// which the last extract found empty are recorded: heights above the
+	// postgres head have not been produced yet, and heights within the
+	// confirmation depth may still gain blocks.
+	if skippedEnd != nil && height.Cmp(skippedEnd) <= 0 {
+		err := WriteReplicatedRange(sdbConn, height, skippedEnd)
 		if err != nil {
-			return nil, err
+			return height, false, err
 		}
+	}
 
-		rows, err := pgConn.Query(query, args...)
-		if err != nil {
-			return nil, err
-		}
+	return height, true, nil
+}
 
-		scanner := sqlscan.NewRowScanner(rows)
-		keys := make([]string, 0)
-		for rows.Next() {
-			err := scanner.Scan(dst)
-			if err != nil {
-				return nil, err
-			}
-			err = loader.WriteRow(table, dst)
-			if err != nil {
-				return nil, err
-			}
-			if collectKeys {
-				keys = append(keys, dst.Key())
-			}
-			MetricReplicatedRows.Inc()
+// Extract reads up to limit blocks starting at baseHeight, along with all of
+// the rows which belong to them, from Postgres into memory. Every query reads
+// from the same Postgres snapshot so the batch is internally consistent.
+func Extract(ctx context.Context, pgConn *sql.DB, sdbConn *sql.DB, baseHeight *big.Int, limit int, opts ExtractOptions) (*PreparedBatch, error) {
+	batch, _, err := extract(ctx, pgConn, sdbConn, baseHeight, limit, opts)
+	return batch, err
+}
+
+// extract is Extract, also returning the height up to which it found no
+// blocks when it returns no batch: opts.EndHeight capped at the finalized
+// height and at the Postgres head in the snapshot, or nil without EndHeight.
+// Batches larger than opts.MaxBytes are split in half until they fit.
+func extract(ctx context.Context, pgConn *sql.DB, sdbConn *sql.DB, baseHeight *big.Int, limit int, opts ExtractOptions) (*PreparedBatch, *big.Int, error) {
+	for {
+		batch, emptyEnd, err := extractBlocks(ctx, pgConn, sdbConn, baseHeight, limit, opts)
+		var tooLarge *BatchTooLargeError
+		if errors.As(err, &tooLarge) && tooLarge.Blocks > 1 {
+			limit = tooLarge.Blocks / 2
+			log.Printf("%s; extracting %d blocks from height %s instead", tooLarge, limit, baseHeight)
+			continue
 		}
-		return keys, nil
+		return batch, emptyEnd, err
 	}
+}
 
-	transactionHashes, err := simpleReplicate(true, "transactions", &Transaction{}, "select * from transactions where included_in_block_hash = ANY($1)", pq.Array(blockHashes))
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to replicate transactions")
+func extractBlocks(ctx context.Context, pgConn *sql.DB, sdbConn *sql.DB, baseHeight *big.Int, limit int, opts ExtractOptions) (_ *PreparedBatch, _ *big.Int, err error) {
+	if opts.DryRun {
+		opts.SkipChainCheck = true
+		opts.ReconcileDeletes = false
 	}
 
-	receiptIDs, err := simpleReplicate(true, "receipts", &Receipt{}, "select * from receipts where included_in_block_hash = ANY($1)", pq.Array(blockHashes))
+	snapshot, err := beginSnapshot(ctx, pgConn)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to replicate receipts")
+		return nil, nil, err
 	}
+	defer snapshot.Close()
 
-	numParallel := 0
-	results := make(chan error)
-
-	simpleReplicateParallel := func(table string, dst Model, query string, args ...interface{}) {
-		numParallel++
-		go func() {
-			_, err = simpleReplicate(false, table, dst, query, args...)
-			if err != nil {
-				results <- errors.Wrapf(err, "failed to replicate %s", table)
-			} else {
-				results <- nil
-			}
-		}()
+	var pgHeight, finalizedHeight *big.Int
+	if opts.ConfirmationDepth > 0 || opts.EndHeight != nil {
+		pgHeight, err = ReadMaxBlockHeight(snapshot.tx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.ConfirmationDepth > 0 {
+		finalizedHeight = (&big.Int{}).Sub(pgHeight, big.NewInt(opts.ConfirmationDepth))
+		if !opts.Optimistic && (opts.EndHeight == nil || finalizedHeight.Cmp(opts.EndHeight) < 0) {
+			opts.EndHeight = finalizedHeight
+		}
 	}
 
-	simpleReplicateParallel("access_keys", &AccessKey{}, "select * from access_keys where last_update_block_height >= $1", baseHeight.String())
-
-	simpleReplicateParallel("account_changes", &AccountChange{}, "select * from account_changes where changed_in_block_hash = ANY($1)", pq.Array(blockHashes))
-
-	simpleReplicateParallel("accounts", &Account{}, "select * from accounts where last_update_block_height >= $1", baseHeight.String())
+	heightFilter := "block_height >= $1"
+	heightArgs := []interface{}{baseHeight.String()}
+	if opts.EndHeight != nil {
+		heightFilter += " and block_height <= $2"
+		heightArgs = append(heightArgs, opts.EndHeight.String())
+	}
 
-	simpleReplicateParallel("action_receipt_actions", &ActionReceiptAction{}, "select * from action_receipt_actions where receipt_id = ANY($1)", pq.Array(receiptIDs))
+	rowCount := snapshot.tx.QueryRowContext(ctx, "select count(*) from blocks where "+heightFilter, heightArgs...)
+	var blockCount int64
+	err = rowCount.Scan(&blockCount)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read count from row")
+	}
+	emptyEnd := opts.EndHeight
+	if emptyEnd != nil && pgHeight.Cmp(emptyEnd) < 0 {
+		emptyEnd = pgHeight
+	}
+	if blockCount == 0 {
+		return nil, emptyEnd, nil
+	}
 
-	simpleReplicateParallel("action_receipt_input_data", &ActionReceiptInputData{}, "select * from action_receipt_input_data where input_to_receipt_id = ANY($1)", pq.Array(receiptIDs))
+	rows, err := snapshot.tx.QueryContext(ctx,
+		fmt.Sprintf("select * from blocks where %s order by block_height asc limit $%d", heightFilter, len(heightArgs)+1),
+		append(heightArgs, limit)...)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read blocks")
+	}
+	defer rows.Close()
 
-	simpleReplicateParallel("action_receipt_output_data", &ActionReceiptOutputData{}, "select * from action_receipt_output_data where output_from_receipt_id = ANY($1)", pq.Array(receiptIDs))
+	scanner, err := newRowScanner(rows)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read blocks")
+	}
+	blocks := make([]*Block, 0, limit)
+	for rows.Next() {
+		dst := &Block{}
+		err := scanner.Scan(dst)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to scan into &Block{}")
+		}
+		blocks = append(blocks, dst)
+	}
+	if len(blocks) == 0 {
+		return nil, nil, errors.Errorf("postgres has %d blocks from height %s but none were read", blockCount, baseHeight)
+	}
+	defer func() {
+		// the loader does not know how many blocks the batch has
+		var tooLarge *BatchTooLargeError
+		if errors.As(err, &tooLarge) {
+			tooLarge.Blocks = len(blocks)
+		}
+	}()
 
-	simpleReplicateParallel("action_receipts", &ActionReceipt{}, "select * from action_receipts where receipt_id = ANY($1)", pq.Array(receiptIDs))
+	tables := opts.Tables
+	if tables == nil {
+		tables = DefaultTableGraph
+	}
 
-	simpleReplicateParallel("chunks", &Chunk{}, "select * from chunks where included_in_block_hash = ANY($1)", pq.Array(blockHashes))
+	err = verifyBatchChain(blocks)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.Prev != nil {
+		if blocks[0].PrevBlockHash != opts.Prev.lastBlockHash {
+			err = ErrChainBroken
+		}
+	} else if !opts.SkipChainCheck {
+		err = verifyChain(ctx, pgConn, sdbConn, opts.Sink, tables, blocks)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	sink := opts.Sink
+	if opts.DryRun {
+		sink = NewDiscardSink()
+	} else if sink == nil {
+		sink = NewSingleStoreSink(sdbConn)
+	}
+	loader, err := NewLoader(sink, tables)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to open batch")
+	}
+	loader.maxBytes = opts.MaxBytes
+	prepared := false
+	defer func() {
+		if !prepared {
+			loader.Abort()
+		}
+	}()
 
-	simpleReplicateParallel("data_receipts", &DataReceipt{}, "select * from data_receipts where receipt_id = ANY($1)", pq.Array(receiptIDs))
+	// blocks are always read, but are only loaded when repairing other
+	// tables if they were asked for
+	loadBlocks := tables.Loads(RootTable)
+	if loadBlocks {
+		err = loader.Touch(RootTable)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
-	simpleReplicateParallel("execution_outcome_receipts", &ExecutionOutcomeReceipt{}, "select * from execution_outcome_receipts where executed_receipt_id = ANY($1) or produced_receipt_id = ANY($1)", pq.Array(receiptIDs))
+	blockHashes := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		blockHashes = append(blockHashes, block.Key())
+		if !loadBlocks {
+			continue
+		}
+		block.Finalized = finalizedHeight == nil || block.Height().Cmp(finalizedHeight) <= 0
+		err = loader.WriteRow(RootTable, block)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to write row to loader")
+		}
+		MetricReplicatedRows.Inc()
+		MetricReplicatedBlocks.Inc()
+	}
+	maxBlockHeight := blocks[len(blocks)-1].Height()
 
-	simpleReplicateParallel("execution_outcomes", &ExecutionOutcome{}, "select * from execution_outcomes where executed_in_block_hash = ANY($1)", pq.Array(blockHashes))
+	mutableStartHeight := (&big.Int{}).Sub(baseHeight, big.NewInt(opts.MutableLookback))
+	if mutableStartHeight.Sign() < 0 {
+		mutableStartHeight.SetInt64(0)
+	}
 
-	simpleReplicateParallel("transaction_actions", &TransactionAction{}, "select * from transaction_actions where transaction_hash = ANY($1)", pq.Array(transactionHashes))
+	// accounts and access_keys are updated in place, so they are read by the
+	// height of their last update rather than by block hash. Rows updated
+	// after this batch are picked up by the batch which contains the update.
+	err = tables.extract(ctx, snapshot, loader, blockHashes, mutableStartHeight, maxBlockHeight.String(), opts.Accounts)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	var lastError error
-	for i := 0; i < numParallel; i++ {
-		err = <-results
+	if len(opts.Stale) > 0 {
+		err = rereadStale(ctx, snapshot.tx, loader, tables, opts.Accounts, opts.Stale)
 		if err != nil {
-			log.Printf("error while loading into SingleStore: %+v", err)
-			lastError = err
+			return nil, nil, err
 		}
 	}
-	if lastError != nil {
-		return nil, lastError
+
+	if opts.ReconcileDeletes {
+		err = reconcileDeletes(ctx, snapshot.tx, sdbConn, loader, tables, blocks, mutableStartHeight, maxBlockHeight.String())
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to reconcile deletes")
+		}
 	}
 
-	err = loader.Close()
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to finalize the load")
+	if opts.Optimistic && finalizedHeight != nil {
+		err = loader.Finalize(finalizedHeight)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	if untouched := loader.UntouchedTables(); len(untouched) > 0 {
-		return nil, errors.Errorf("the following tables are not being replicated to: %v", untouched)
+		return nil, nil, errors.Errorf("the following tables are not being replicated to: %v", untouched)
 	}
 
-	return ParseBigInt(maxBlockHeight), nil
+	prepared = true
+	return &PreparedBatch{
+		Batch: Batch{
+			StartHeight:    baseHeight,
+			MaxBlockHeight: maxBlockHeight,
+			Blocks:         len(blocks),
+			Rows:           loader.Rows(),
+		},
+		loader:         loader,
+		lastBlockHash:  blocks[len(blocks)-1].BlockHash,
+		skipCheckpoint: opts.SkipCheckpoint,
+	}, nil, nil
 }
@@ -0,0 +1,166 @@
+package src
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestReplicateRangeRecordsEmptyHeights(t *testing.T) {
+	tests := []struct {
+		name  string
+		depth int64
+		end   int64
+		want  string
+	}{
+		{"below the head", 0, 80, "REPLACE INTO replication_meta (start_height, block_height) VALUES (?, ?) [50 80]"},
+		{"above the head", 0, 200, "REPLACE INTO replication_meta (start_height, block_height) VALUES (?, ?) [50 100]"},
+		{"within the confirmation depth", 10, 200, "REPLACE INTO replication_meta (start_height, block_height) VALUES (?, ?) [50 90]"},
+		{"nothing finalized", 60, 200, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pgConn, _ := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+				switch {
+				case query == "select pg_export_snapshot()":
+					return []string{"pg_export_snapshot"}, [][]string{{"00000003-1"}}, nil
+				case strings.HasPrefix(query, "SELECT coalesce(MAX(block_height), 0) FROM blocks"):
+					return []string{"coalesce"}, [][]string{{"100"}}, nil
+				case strings.HasPrefix(query, "select count(*) from blocks"):
+					return []string{"count"}, [][]string{{"0"}}, nil
+				}
+				return nil, nil, nil
+			})
+			var recorded []string
+			sdbConn, _ := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+				if strings.HasPrefix(query, "REPLACE INTO replication_meta") {
+					recorded = append(recorded, query+" ["+args[0].(string)+" "+args[1].(string)+"]")
+				}
+				return nil, nil, nil
+			})
+
+			opts := ExtractOptions{ConfirmationDepth: tt.depth}
+			height, done, err := ReplicateRange(context.Background(), context.Background(), pgConn, sdbConn, big.NewInt(50), big.NewInt(tt.end), 10, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !done || height.Int64() != 50 {
+				t.Errorf("ReplicateRange = %s, %v, want 50, true", height, done)
+			}
+			got := strings.Join(recorded, "\n")
+			if got != tt.want {
+				t.Errorf("recorded %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplicateRangeRecordsNothingWithoutBlocks(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		count string
+	}{
+		{"zero batch size", 0, "5"},
+		{"blocks counted but not read", 10, "5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pgConn, _ := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+				switch {
+				case query == "select pg_export_snapshot()":
+					return []string{"pg_export_snapshot"}, [][]string{{"00000003-1"}}, nil
+				case strings.HasPrefix(query, "SELECT coalesce(MAX(block_height), 0) FROM blocks"):
+					return []string{"coalesce"}, [][]string{{"100"}}, nil
+				case strings.HasPrefix(query, "select count(*) from blocks"):
+					return []string{"count"}, [][]string{{tt.count}}, nil
+				case strings.HasPrefix(query, "select * from blocks"):
+					return []string{"block_height"}, nil, nil
+				}
+				return nil, nil, nil
+			})
+			sdbConn, sdb := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+				return nil, nil, nil
+			})
+
+			height, done, err := ReplicateRange(context.Background(), context.Background(), pgConn, sdbConn, big.NewInt(50), big.NewInt(80), tt.limit, ExtractOptions{})
+			if err == nil {
+				t.Fatal("ReplicateRange succeeded")
+			}
+			if done || height.Int64() != 50 {
+				t.Errorf("ReplicateRange = %s, %v, want 50, false", height, done)
+			}
+			for _, stmt := range sdb.Statements() {
+				if strings.HasPrefix(stmt, "REPLACE INTO replication_meta") {
+					t.Errorf("recorded %q", stmt)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractSplitsLargeBatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		want     []string
+		blocks   int
+	}{
+		{"fits", 1 << 20, []string{"4"}, 4},
+		{"split", 300, []string{"4", "2", "1"}, 1},
+		{"single block too large", 10, []string{"4", "2", "1"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var limits []string
+			pgConn, _ := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+				switch {
+				case query == "select pg_export_snapshot()":
+					return []string{"pg_export_snapshot"}, [][]string{{"00000003-1"}}, nil
+				case strings.HasPrefix(query, "select count(*) from blocks"):
+					return []string{"count"}, [][]string{{"4"}}, nil
+				case strings.HasPrefix(query, "select * from blocks"):
+					limit := fmt.Sprint(args[len(args)-1])
+					limits = append(limits, limit)
+					n, _ := strconv.Atoi(limit)
+					var rows [][]string
+					prev := ""
+					for i := 0; i < n && i < 4; i++ {
+						hash := fmt.Sprintf("%0100d", i)
+						rows = append(rows, []string{fmt.Sprint(50 + i), hash, prev})
+						prev = hash
+					}
+					return []string{"block_height", "block_hash", "prev_block_hash"}, rows, nil
+				}
+				return nil, nil, nil
+			})
+			tables, err := DefaultTableGraph.Select([]string{RootTable}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			opts := ExtractOptions{DryRun: true, Tables: tables, MaxBytes: tt.maxBytes}
+			batch, err := Extract(context.Background(), pgConn, nil, big.NewInt(50), 4, opts)
+			if tt.blocks == 0 {
+				var tooLarge *BatchTooLargeError
+				if !errors.As(err, &tooLarge) || tooLarge.Blocks != 1 {
+					t.Errorf("Extract returned %v, want a batch of 1 block which is too large", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if batch.Blocks != tt.blocks {
+				t.Errorf("extracted %d blocks, want %d", batch.Blocks, tt.blocks)
+			}
+			if !reflect.DeepEqual(limits, tt.want) {
+				t.Errorf("read blocks with limits %v, want %v", limits, tt.want)
+			}
+		})
+	}
+}
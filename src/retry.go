@@ -0,0 +1,148 @@
+package src
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// retryableMySQLErrors are SingleStore error codes which are expected to go
+// away on their own
+var retryableMySQLErrors = map[uint16]bool{
+	1205: true, // lock wait timeout exceeded
+	1213: true, // deadlock found when trying to get lock
+	1735: true, // unable to connect to a leaf, usually during a failover
+	2006: true, // server has gone away
+	2013: true, // lost connection to server during query
+}
+
+// retryablePostgresErrors are Postgres error codes (or classes, when only two
+// characters long) which are expected to go away on their own
+var retryablePostgresErrors = []string{
+	"08",    // connection exception
+	"40001", // serialization failure
+	"40P01", // deadlock detected
+	"53300", // too many connections
+	"57P01", // admin shutdown
+	"57P02", // crash shutdown
+	"57P03", // cannot connect now
+}
+
+// postgresErrorCode returns the SQLSTATE of a Postgres error from either
+// driver: pgconn, used for replication and COPY, or pgx v3, which
+// database/sql connections go through.
+func postgresErrorCode(err error) (string, bool) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code, true
+	}
+	var pgxErr pgx.PgError
+	if errors.As(err, &pgxErr) {
+		return pgxErr.Code, true
+	}
+	var pgxErrPtr *pgx.PgError
+	if errors.As(err, &pgxErrPtr) {
+		return pgxErrPtr.Code, true
+	}
+	return "", false
+}
+
+// IsRetryable reports whether err is likely to be transient, such as a
+// dropped connection or a deadlock, rather than a bug or a bad row which
+// will fail again no matter how many times it is retried.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// cancellation means we are shutting down
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return retryableMySQLErrors[mysqlErr.Number]
+	}
+
+	if state, ok := postgresErrorCode(err); ok {
+		for _, code := range retryablePostgresErrors {
+			if strings.HasPrefix(state, code) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// RetryPolicy configures how Retry backs off between attempts.
+type RetryPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// MaxRetries is the number of times to retry before giving up. A negative
+	// value retries forever.
+	MaxRetries int
+}
+
+// backoff returns a random duration up to InitialBackoff * 2^attempt, capped
+// at MaxBackoff.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	max := p.MaxBackoff
+	if attempt < 32 {
+		if d := p.InitialBackoff << uint(attempt); d > 0 && d < max {
+			max = d
+		}
+	}
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max))) + 1
+}
+
+// Retry calls fn until it succeeds, returns an error which is not retryable,
+// runs out of retries, or ctx is cancelled while backing off. The last error
+// is returned in every case other than success.
+func Retry(ctx context.Context, policy RetryPolicy, operation string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if !IsRetryable(err) {
+			return err
+		}
+		if policy.MaxRetries >= 0 && attempt >= policy.MaxRetries {
+			return errors.Wrapf(err, "%s failed after %d retries", operation, attempt)
+		}
+
+		delay := policy.backoff(attempt)
+		log.Printf("%s failed, retrying in %s: %v", operation, delay, err)
+		MetricRetries.WithLabelValues(operation).Inc()
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
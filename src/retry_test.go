@@ -0,0 +1,91 @@
+package src
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"canceled", errors.Wrap(context.Canceled, "query"), false},
+		{"deadline", context.DeadlineExceeded, false},
+
+		{"pgconn serialization failure", &pgconn.PgError{Code: "40001"}, true},
+		{"pgconn deadlock", errors.Wrap(&pgconn.PgError{Code: "40P01"}, "query"), true},
+		{"pgconn connection class", &pgconn.PgError{Code: "08006"}, true},
+		{"pgconn admin shutdown", &pgconn.PgError{Code: "57P01"}, true},
+		{"pgconn syntax error", &pgconn.PgError{Code: "42601"}, false},
+		{"pgconn query canceled", &pgconn.PgError{Code: "57014"}, false},
+
+		{"pgx serialization failure", pgx.PgError{Code: "40001"}, true},
+		{"pgx deadlock", errors.Wrap(pgx.PgError{Code: "40P01"}, "query"), true},
+		{"pgx too many connections", pgx.PgError{Code: "53300"}, true},
+		{"pgx cannot connect now", pgx.PgError{Code: "57P03"}, true},
+		{"pgx pointer", &pgx.PgError{Code: "40001"}, true},
+		{"pgx unique violation", pgx.PgError{Code: "23505"}, false},
+
+		{"mysql deadlock", &mysql.MySQLError{Number: 1213}, true},
+		{"mysql gone away", errors.Wrap(&mysql.MySQLError{Number: 2006}, "load"), true},
+		{"mysql syntax error", &mysql.MySQLError{Number: 1064}, false},
+		{"mysql invalid conn", mysql.ErrInvalidConn, true},
+
+		{"bad conn", driver.ErrBadConn, true},
+		{"eof", errors.Wrap(io.ErrUnexpectedEOF, "read"), true},
+		{"net error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"other", errors.New("bad row"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 3}
+
+	calls := 0
+	err := Retry(context.Background(), policy, "test", func() error {
+		calls++
+		if calls < 3 {
+			return pgx.PgError{Code: "40001"}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("Retry returned %v after %d calls, want nil after 3", err, calls)
+	}
+
+	calls = 0
+	err = Retry(context.Background(), policy, "test", func() error {
+		calls++
+		return pgx.PgError{Code: "42601"}
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("Retry returned %v after %d calls, want an error after 1", err, calls)
+	}
+
+	calls = 0
+	err = Retry(context.Background(), policy, "test", func() error {
+		calls++
+		return driver.ErrBadConn
+	})
+	if err == nil || calls != 4 {
+		t.Fatalf("Retry returned %v after %d calls, want an error after 4", err, calls)
+	}
+}
@@ -0,0 +1,425 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/hamba/avro"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+)
+
+type Stream struct {
+	table         string
+	model         ModelInfo
+	readID        string
+	loadDataQuery string
+	rows          int
+	w             *avro.Encoder
+	buf           *bytes.Buffer
+	out           *countingWriter
+
+	// keyFields is nil unless rows can be deleted from the table
+	keyFields []string
+
+	// written holds the key of every row written to a deletable table, so
+	// that a row deleted after being written in the same batch is deleted
+	// after the load rather than before it
+	written      map[string]bool
+	deleteBefore map[string]Model
+	deleteAfter  map[string]Model
+	deleted      int64
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func NewStream(model ModelInfo) *Stream {
+	return newStream(model, nil, true)
+}
+
+// newStream returns a stream which encodes rows for model into dst. If dst is
+// nil the rows are buffered until LoadData is called; otherwise the stream
+// can not be loaded with LoadData. If replace is set loaded rows replace the
+// rows with the same key, otherwise such rows are an error.
+func newStream(model ModelInfo, dst io.Writer, replace bool) *Stream {
+	var buf *bytes.Buffer
+	if dst == nil {
+		buf = &bytes.Buffer{}
+		dst = buf
+	}
+	out := &countingWriter{w: dst}
+	w := avro.NewEncoderForSchema(model.Schema, out)
+
+	var columnMap, decimals []string
+	for fieldName, columnName := range model.FieldMap {
+		field, _ := model.Type.FieldByName(fieldName)
+		if isDecimal(field.Type) {
+			columnMap = append(columnMap, fmt.Sprintf("@%s <- %s", columnName, fieldName))
+			decimals = append(decimals, fmt.Sprintf("%s = %s", columnName, decimalFromBytes("@"+columnName)))
+			continue
+		}
+		columnMap = append(columnMap, fmt.Sprintf("%s <- %s", columnName, fieldName))
+	}
+	sort.Strings(columnMap)
+	sort.Strings(decimals)
+	set := ""
+	if len(decimals) > 0 {
+		set = "SET " + strings.Join(decimals, ", ")
+	}
+
+	readID := uuid.NewV4().String()
+	into := "INTO"
+	if replace {
+		into = "REPLACE INTO"
+	}
+	query := fmt.Sprintf(`
+		LOAD DATA LOCAL INFILE 'Reader::%s'
+		%s TABLE %s
+		FORMAT AVRO
+		( %s )
+		%s
+		SCHEMA '%s'
+		ERRORS HANDLE '%s'
+	`, readID, into, model.Table, strings.Join(columnMap, ", "), set, model.Schema.String(), model.Table)
+
+	s := &Stream{
+		table:         model.Table,
+		model:         model,
+		readID:        readID,
+		loadDataQuery: query,
+		w:             w,
+		buf:           buf,
+		out:           out,
+	}
+
+	if keyFields, ok := deleteKeys[model.Table]; ok {
+		s.keyFields = keyFields
+		s.written = make(map[string]bool)
+		s.deleteBefore = make(map[string]Model)
+		s.deleteAfter = make(map[string]Model)
+	}
+
+	return s
+}
+
+// decimalBytes is the number of bytes of the two's complement form of every
+// integer with up to decimalPrecision digits, and decimalChunk the number of
+// bytes which CONV converts exactly.
+const (
+	decimalBytes = 19
+	decimalChunk = 7
+)
+
+// decimalFromBytes returns an expression which converts variable, an Avro
+// decimal loaded into SingleStore as its underlying big endian two's
+// complement bytes, into a DECIMAL. SingleStore does not convert logical
+// types itself, and CONV only handles 64 bit integers, so the bytes are sign
+// extended to decimalBytes and converted decimalChunk bytes at a time. A NULL
+// variable converts to NULL.
+func decimalFromBytes(variable string) string {
+	negative := fmt.Sprintf("ASCII(%s) >= 128", variable)
+	padded := fmt.Sprintf("LPAD(%s, %d, IF(%s, x'FF', x'00'))", variable, decimalBytes, negative)
+
+	var terms []string
+	for end := decimalBytes; end > 0; end -= decimalChunk {
+		start := end - decimalChunk
+		if start < 0 {
+			start = 0
+		}
+		term := fmt.Sprintf("CAST(CONV(HEX(SUBSTR(%s, %d, %d)), 16, 10) AS DECIMAL(65,0))", padded, start+1, end-start)
+		if end < decimalBytes {
+			term += fmt.Sprintf(" * %s", new(big.Int).Lsh(big.NewInt(1), uint(8*(decimalBytes-end))))
+		}
+		terms = append([]string{term}, terms...)
+	}
+	sign := new(big.Int).Lsh(big.NewInt(1), 8*decimalBytes)
+	return fmt.Sprintf("%s - IF(%s, %s, 0)", strings.Join(terms, " + "), negative, sign)
+}
+
+// LoadData loads every row written to the stream so far using the provided
+// transaction. Nothing is visible in SingleStore until the transaction commits.
+func (s *Stream) LoadData(ctx context.Context, tx *sql.Tx) error {
+	if s.rows == 0 {
+		return nil
+	}
+	if s.buf == nil {
+		return errors.Errorf("can not load %s from an unbuffered stream", s.table)
+	}
+
+	_, err := s.loadFrom(ctx, tx, bytes.NewReader(s.buf.Bytes()))
+	return err
+}
+
+// loadFrom runs the LOAD DATA query of the stream with r as the file, which
+// must contain rows encoded by the stream.
+func (s *Stream) loadFrom(ctx context.Context, tx *sql.Tx, r io.Reader) (sql.Result, error) {
+	mysql.RegisterReaderHandler(s.readID, func() io.Reader { return r })
+	defer mysql.DeregisterReaderHandler(s.readID)
+
+	return tx.ExecContext(ctx, s.loadDataQuery)
+}
+
+func isInBasicMultilingualPlane(r rune) bool {
+	return r <= 0xffff
+}
+
+// BMP represents all runes in the Basic Multilingual Plane
+// Runes above this range are not supported until SingleStore 7.5
+var BMP = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x0000, 0xffff, 1},
+	},
+}
+
+var NotBMP = runes.NotIn(BMP)
+
+var MapNotBMP = runes.Map(func(r rune) rune {
+	if NotBMP.Contains(r) {
+		return '�'
+	}
+	return r
+})
+
+func (s *Stream) WriteRow(row Model) error {
+	var err error
+	switch r := row.(type) {
+	case *ActionReceiptAction:
+		r.Args, _, err = transform.String(MapNotBMP, r.Args)
+		if err != nil {
+			panic(fmt.Sprintf("failed to sanitize non-bmp characters in string %q", r.Args))
+		}
+	case *TransactionAction:
+		r.Args, _, err = transform.String(MapNotBMP, r.Args)
+		if err != nil {
+			panic(fmt.Sprintf("failed to sanitize non-bmp characters in string %q", r.Args))
+		}
+	}
+
+	err = s.model.checkDecimals(row)
+	if err != nil {
+		return err
+	}
+	err = s.w.Encode(row)
+	if err != nil {
+		return err
+	}
+	s.rows++
+
+	if s.written != nil {
+		key := row.Key()
+		s.written[key] = true
+		delete(s.deleteAfter, key)
+	}
+	return nil
+}
+
+// Delete removes row, which only needs its key fields set, from SingleStore
+// when the batch is committed.
+func (s *Stream) Delete(row Model) error {
+	if s.keyFields == nil {
+		return errors.Errorf("rows cannot be deleted from %s", s.table)
+	}
+
+	key := row.Key()
+	if s.written[key] {
+		s.deleteAfter[key] = row
+	} else {
+		s.deleteBefore[key] = row
+	}
+	return nil
+}
+
+// SingleStoreSink loads every batch into SingleStore in a single transaction
+// along with the replication_meta checkpoint, so a batch is either fully
+// replicated or not at all. Rows are buffered in memory as Avro and loaded
+// with LOAD DATA. Extract keeps them below ExtractOptions.MaxBytes.
+type SingleStoreSink struct {
+	sdbConn *sql.DB
+}
+
+func NewSingleStoreSink(sdbConn *sql.DB) *SingleStoreSink {
+	return &SingleStoreSink{sdbConn: sdbConn}
+}
+
+// NewDiscardSink returns a sink which encodes rows like SingleStoreSink but
+// throws them away, for measuring a batch without loading it. Committing its
+// batches fails.
+func NewDiscardSink() *SingleStoreSink {
+	return &SingleStoreSink{}
+}
+
+// Rewind deletes every replicated row above height, like a rewind after a
+// chain reorganization.
+func (s *SingleStoreSink) Rewind(ctx context.Context, height *big.Int) error {
+	if s.sdbConn == nil {
+		return errors.New("rows can not be rewound from a discard sink")
+	}
+	return Rewind(ctx, s.sdbConn, DefaultTableGraph, height)
+}
+
+// Begin returns a batch with a stream for every table loaded by tables.
+func (s *SingleStoreSink) Begin(tables *TableGraph) (SinkBatch, error) {
+	b := &singleStoreBatch{
+		sdbConn: s.sdbConn,
+		streams: make(map[string]*Stream),
+	}
+
+	var dst io.Writer
+	if s.sdbConn == nil {
+		dst = ioutil.Discard
+	}
+	for _, model := range Models {
+		if tables.Loads(model.Table) {
+			b.streams[model.Table] = newStream(model, dst, true)
+		}
+	}
+
+	return b, nil
+}
+
+type singleStoreBatch struct {
+	sdbConn    *sql.DB
+	streams    map[string]*Stream
+	statements []batchStatement
+}
+
+type batchStatement struct {
+	query string
+	args  []interface{}
+}
+
+func (b *singleStoreBatch) stream(table string) (*Stream, error) {
+	s, ok := b.streams[table]
+	if !ok {
+		return nil, errors.Errorf("no table with name %s", table)
+	}
+	return s, nil
+}
+
+func (b *singleStoreBatch) WriteRow(table string, row Model) error {
+	s, err := b.stream(table)
+	if err != nil {
+		return err
+	}
+	return s.WriteRow(row)
+}
+
+func (b *singleStoreBatch) Delete(table string, row Model) error {
+	s, err := b.stream(table)
+	if err != nil {
+		return err
+	}
+	return s.Delete(row)
+}
+
+// Finalize queues an update of the finalized column to run after every
+// stream has been loaded.
+func (b *singleStoreBatch) Finalize(height *big.Int) error {
+	b.statements = append(b.statements, batchStatement{
+		query: "UPDATE blocks SET finalized = TRUE WHERE finalized = FALSE AND block_height <= ?",
+		args:  []interface{}{height.String()},
+	})
+	return nil
+}
+
+// EncodedBytes returns the size of the rows written to table once encoded as
+// Avro.
+func (b *singleStoreBatch) EncodedBytes(table string) int64 {
+	if s, ok := b.streams[table]; ok {
+		return s.out.n
+	}
+	return 0
+}
+
+// Commit loads every stream into SingleStore and records the replicated range
+// of blocks in replication_meta within one transaction. A nil endHeight
+// leaves replication_meta untouched. If ctx is cancelled before the
+// transaction commits the whole batch is rolled back.
+func (b *singleStoreBatch) Commit(ctx context.Context, startHeight *big.Int, endHeight *big.Int) error {
+	if b.sdbConn == nil {
+		return errors.New("can not commit a discarding batch")
+	}
+
+	tables := make([]string, 0, len(b.streams))
+	for table := range b.streams {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	tx, err := b.sdbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	for _, table := range tables {
+		s := b.streams[table]
+		s.deleted = 0
+		err = s.deleteRows(ctx, tx, s.deleteBefore)
+		if err != nil {
+			return errors.Wrapf(err, "failed to delete from %s", table)
+		}
+		err = s.LoadData(ctx, tx)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load %s", table)
+		}
+		err = s.deleteRows(ctx, tx, s.deleteAfter)
+		if err != nil {
+			return errors.Wrapf(err, "failed to delete from %s", table)
+		}
+	}
+
+	for _, stmt := range b.statements {
+		_, err = tx.ExecContext(ctx, stmt.query, stmt.args...)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute statement")
+		}
+	}
+
+	if endHeight != nil {
+		err = WriteReplicatedRange(tx, startHeight, endHeight)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit batch")
+	}
+
+	for _, table := range tables {
+		if deleted := b.streams[table].deleted; deleted > 0 {
+			MetricDeletedRows.WithLabelValues(table).Add(float64(deleted))
+		}
+	}
+	return nil
+}
+
+// Abort drops the buffered rows. Nothing has been sent to SingleStore yet.
+func (b *singleStoreBatch) Abort() error {
+	b.streams = nil
+	b.statements = nil
+	return nil
+}
@@ -0,0 +1,172 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hamba/avro"
+)
+
+func TestStreamDeleteOrdering(t *testing.T) {
+	var deletes []string
+	sdbConn, sdb := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+		if strings.HasPrefix(query, "DELETE FROM accounts") {
+			deletes = append(deletes, fmt.Sprint(args))
+		}
+		return nil, nil, nil
+	})
+
+	tables, err := DefaultTableGraph.Select([]string{"accounts"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := NewSingleStoreSink(sdbConn).Begin(tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		delete bool
+		id     int64
+	}{
+		// written then deleted: deleted after the load
+		{false, 1}, {true, 1},
+		// deleted then written: deleted before the load
+		{true, 2}, {false, 2},
+		// only deleted
+		{true, 3},
+		// deleted, written and deleted again
+		{true, 4}, {false, 4}, {true, 4},
+	}
+	for _, step := range steps {
+		if step.delete {
+			err = batch.Delete("accounts", &Account{Id: step.id})
+		} else {
+			err = batch.WriteRow("accounts", &Account{Id: step.id, AccountId: "alice.near"})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = batch.Commit(context.Background(), big.NewInt(5), big.NewInt(9))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var statements []string
+	for _, stmt := range sdb.Statements() {
+		if strings.HasPrefix(stmt, "LOAD DATA") {
+			stmt = "LOAD DATA"
+		}
+		statements = append(statements, stmt)
+	}
+	wantStatements := []string{
+		"BEGIN",
+		"DELETE FROM accounts WHERE (id = ?) OR (id = ?) OR (id = ?)",
+		"LOAD DATA",
+		"DELETE FROM accounts WHERE (id = ?) OR (id = ?)",
+		"REPLACE INTO replication_meta (start_height, block_height) VALUES (?, ?)",
+		"COMMIT",
+	}
+	if !reflect.DeepEqual(statements, wantStatements) {
+		t.Errorf("statements = %q, want %q", statements, wantStatements)
+	}
+	wantDeletes := []string{"[2 3 4]", "[1 4]"}
+	if !reflect.DeepEqual(deletes, wantDeletes) {
+		t.Errorf("deleted %v, want %v", deletes, wantDeletes)
+	}
+}
+
+// evalDecimalFromBytes evaluates the expression returned by decimalFromBytes
+// for the variable @v set to b, following the semantics of LPAD, SUBSTR and
+// CONV in SingleStore.
+func evalDecimalFromBytes(t *testing.T, expr string, b []byte) *big.Int {
+	t.Helper()
+	pad := byte(0)
+	if len(b) > 0 && b[0] >= 128 {
+		pad = 0xff
+	}
+	padded := append(bytes.Repeat([]byte{pad}, decimalBytes-len(b)), b...)
+
+	terms := regexp.MustCompile(`SUBSTR\(LPAD\(@v, \d+, IF\(ASCII\(@v\) >= 128, x'FF', x'00'\)\), (\d+), (\d+)\)\), 16, 10\) AS DECIMAL\(65,0\)\)(?: \* (\d+))?`).FindAllStringSubmatch(expr, -1)
+	if len(terms) == 0 {
+		t.Fatalf("no terms in %s", expr)
+	}
+	out := new(big.Int)
+	for _, term := range terms {
+		start, _ := strconv.Atoi(term[1])
+		length, _ := strconv.Atoi(term[2])
+		chunk := new(big.Int).SetBytes(padded[start-1 : start-1+length])
+		if chunk.BitLen() > 64 {
+			t.Fatalf("CONV of %d bytes overflows", length)
+		}
+		if term[3] != "" {
+			shift, _ := new(big.Int).SetString(term[3], 10)
+			chunk.Mul(chunk, shift)
+		}
+		out.Add(out, chunk)
+	}
+	sign := regexp.MustCompile(` - IF\(ASCII\(@v\) >= 128, (\d+), 0\)$`).FindStringSubmatch(expr)
+	if sign == nil {
+		t.Fatalf("no sign in %s", expr)
+	}
+	if b[0] >= 128 {
+		offset, _ := new(big.Int).SetString(sign[1], 10)
+		out.Sub(out, offset)
+	}
+	return out
+}
+
+func TestDecimalFromBytes(t *testing.T) {
+	schema := avro.NewPrimitiveSchema(avro.Bytes, avro.NewDecimalLogicalSchema(decimalPrecision, 0))
+	expr := decimalFromBytes("@v")
+
+	limit := new(big.Int).Sub(maxDecimal, big.NewInt(1))
+	values := []*big.Int{
+		big.NewInt(0), big.NewInt(1), big.NewInt(-1), big.NewInt(127), big.NewInt(128), big.NewInt(-128), big.NewInt(-129),
+		new(big.Int).Lsh(big.NewInt(1), 56), new(big.Int).Lsh(big.NewInt(1), 112), limit, new(big.Int).Neg(limit),
+	}
+	for _, v := range values {
+		data, err := avro.Marshal(schema, new(big.Rat).SetInt(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := avro.NewReader(bytes.NewReader(data), len(data))
+		b := r.ReadBytes()
+		if len(b) > decimalBytes {
+			t.Errorf("%s is encoded in %d bytes", v, len(b))
+			continue
+		}
+		if got := evalDecimalFromBytes(t, expr, b); got.Cmp(v) != 0 {
+			t.Errorf("%s loaded as %s", v, got)
+		}
+	}
+}
+
+func TestStreamLoadsDecimals(t *testing.T) {
+	var model ModelInfo
+	for _, m := range Models {
+		if m.Table == "chunks" {
+			model = m
+		}
+	}
+	s := newStream(model, nil, true)
+	for _, want := range []string{"@gas_used <- GasUsed", "shard_id <- ShardId", "SET gas_limit = ", ", gas_used = "} {
+		if !strings.Contains(s.loadDataQuery, want) {
+			t.Errorf("LOAD DATA query does not contain %q: %s", want, s.loadDataQuery)
+		}
+	}
+
+	tooLarge := new(big.Rat).SetInt(maxDecimal)
+	err := s.WriteRow(&Chunk{ChunkHash: "a", GasUsed: *tooLarge})
+	if err == nil {
+		t.Error("expected an error writing a decimal with too many digits")
+	}
+}
@@ -0,0 +1,160 @@
+package src
+
+import (
+	"context"
+	"math/big"
+)
+
+// Sink is a destination for replicated rows. Every batch read from Postgres is
+// written to a SinkBatch opened on the sink, which is then either committed
+// or aborted as a whole.
+type Sink interface {
+	// Begin opens a batch which writes to the tables loaded by tables.
+	Begin(tables *TableGraph) (SinkBatch, error)
+}
+
+// SinkBatch receives the rows of one batch. Nothing written to it may be
+// visible until Commit returns. WriteRow and Delete may be called
+// concurrently for different tables, but not for the same table.
+type SinkBatch interface {
+	// WriteRow adds row to table, replacing any row with the same key.
+	WriteRow(table string, row Model) error
+
+	// Delete removes the row with the key of row from table. Only the fields
+	// listed in deleteKeys are set. Writes and deletes of the same key take
+	// effect in the order they were made.
+	Delete(table string, row Model) error
+
+	// Finalize marks the blocks up to height which were written with
+	// Finalized unset, in this batch or an earlier one, as finalized.
+	Finalize(height *big.Int) error
+
+	// Commit makes every change in the batch visible and records that the
+	// blocks between startHeight and endHeight have been replicated. A nil
+	// endHeight commits the changes without recording anything. If ctx is
+	// cancelled before Commit returns, none of the changes are visible.
+	Commit(ctx context.Context, startHeight *big.Int, endHeight *big.Int) error
+
+	// Abort discards a batch which will not be committed.
+	Abort() error
+}
+
+// rewindRecorder is implemented by sinks which keep a record of every rewind
+// of SingleStore after a chain reorganization.
+type rewindRecorder interface {
+	RecordRewind(height *big.Int) error
+}
+
+// rewinder is implemented by sinks which can delete every row above a block
+// height, so that recorded rewinds can be replayed into them.
+type rewinder interface {
+	Rewind(ctx context.Context, height *big.Int) error
+}
+
+// encodedSizer is implemented by batches which can report how large the rows
+// written to each table are once encoded.
+type encodedSizer interface {
+	EncodedBytes(table string) int64
+}
+
+// NewTeeSink returns a sink which writes every batch to all of sinks. Batches
+// are committed to each sink in order, so if a commit fails the sinks before
+// it have already committed the batch and will receive it again when it is
+// retried.
+func NewTeeSink(sinks ...Sink) Sink {
+	return teeSink(sinks)
+}
+
+type teeSink []Sink
+
+func (s teeSink) Begin(tables *TableGraph) (SinkBatch, error) {
+	batches := make(teeBatch, 0, len(s))
+	for _, sink := range s {
+		batch, err := sink.Begin(tables)
+		if err != nil {
+			batches.Abort()
+			return nil, err
+		}
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
+
+// RecordRewind records the rewind in every sink which keeps a record of them.
+func (s teeSink) RecordRewind(height *big.Int) error {
+	for _, sink := range s {
+		if recorder, ok := sink.(rewindRecorder); ok {
+			err := recorder.RecordRewind(height)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type teeBatch []SinkBatch
+
+func (b teeBatch) WriteRow(table string, row Model) error {
+	for _, batch := range b {
+		err := batch.WriteRow(table, row)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b teeBatch) Delete(table string, row Model) error {
+	for _, batch := range b {
+		err := batch.Delete(table, row)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b teeBatch) Finalize(height *big.Int) error {
+	for _, batch := range b {
+		err := batch.Finalize(height)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit commits the batch to each sink in order. The sinks after one which
+// fails are aborted.
+func (b teeBatch) Commit(ctx context.Context, startHeight *big.Int, endHeight *big.Int) error {
+	for i, batch := range b {
+		err := batch.Commit(ctx, startHeight, endHeight)
+		if err != nil {
+			b[i+1:].Abort()
+			return err
+		}
+	}
+	return nil
+}
+
+func (b teeBatch) Abort() error {
+	var lastError error
+	for _, batch := range b {
+		err := batch.Abort()
+		if err != nil {
+			lastError = err
+		}
+	}
+	return lastError
+}
+
+// EncodedBytes returns the size reported by the first sink which reports it.
+func (b teeBatch) EncodedBytes(table string) int64 {
+	for _, batch := range b {
+		if sizer, ok := batch.(encodedSizer); ok {
+			return sizer.EncodedBytes(table)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,80 @@
+package src
+
+import (
+	"context"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// orderedSink logs the commits and aborts of its batches to a log shared with
+// other sinks, and fails every commit if failCommit is set.
+type orderedSink struct {
+	name       string
+	log        *[]string
+	failCommit bool
+}
+
+func (s *orderedSink) Begin(tables *TableGraph) (SinkBatch, error) {
+	return &orderedBatch{sink: s}, nil
+}
+
+type orderedBatch struct {
+	recordingBatch
+	sink *orderedSink
+}
+
+func (b *orderedBatch) Commit(ctx context.Context, startHeight *big.Int, endHeight *big.Int) error {
+	*b.sink.log = append(*b.sink.log, "commit "+b.sink.name)
+	if b.sink.failCommit {
+		return errors.New("commit failed")
+	}
+	return nil
+}
+
+func (b *orderedBatch) Abort() error {
+	*b.sink.log = append(*b.sink.log, "abort "+b.sink.name)
+	return nil
+}
+
+func TestTeeBatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		fail   string
+		abort  bool
+		want   []string
+		errors bool
+	}{
+		{"commit", "", false, []string{"commit a", "commit b", "commit c"}, false},
+		{"first commit fails", "a", false, []string{"commit a", "abort b", "abort c"}, true},
+		{"middle commit fails", "b", false, []string{"commit a", "commit b", "abort c"}, true},
+		{"last commit fails", "c", false, []string{"commit a", "commit b", "commit c"}, true},
+		{"abort", "", true, []string{"abort a", "abort b", "abort c"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log []string
+			var sinks []Sink
+			for _, name := range []string{"a", "b", "c"} {
+				sinks = append(sinks, &orderedSink{name: name, log: &log, failCommit: name == tt.fail})
+			}
+			batch, err := NewTeeSink(sinks...).Begin(DefaultTableGraph)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.abort {
+				err = batch.Abort()
+			} else {
+				err = batch.Commit(context.Background(), big.NewInt(1), big.NewInt(2))
+			}
+			if (err != nil) != tt.errors {
+				t.Errorf("error = %v, want error: %v", err, tt.errors)
+			}
+			if !reflect.DeepEqual(log, tt.want) {
+				t.Errorf("log = %v, want %v", log, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// querier is satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+var snapshotTxOptions = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+
+// pgSnapshot is a read only REPEATABLE READ transaction on Postgres whose
+// snapshot has been exported, so that other connections can read exactly the
+// same data concurrently. The indexer keeps writing while a batch is being
+// extracted, and without a shared snapshot a batch could contain receipts
+// without their outcomes.
+type pgSnapshot struct {
+	pgConn *sql.DB
+	tx     *sql.Tx
+	id     string
+}
+
+func beginSnapshot(ctx context.Context, pgConn *sql.DB) (*pgSnapshot, error) {
+	tx, err := pgConn.BeginTx(ctx, snapshotTxOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start snapshot transaction")
+	}
+
+	var id string
+	err = tx.QueryRowContext(ctx, "select pg_export_snapshot()").Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(err, "failed to export snapshot")
+	}
+
+	return &pgSnapshot{pgConn: pgConn, tx: tx, id: id}, nil
+}
+
+// Join starts another transaction which reads from the same snapshot. It must
+// be called before the snapshot is closed, and the returned transaction
+// should be rolled back once it is no longer needed.
+func (s *pgSnapshot) Join(ctx context.Context) (*sql.Tx, error) {
+	tx, err := s.pgConn.BeginTx(ctx, snapshotTxOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start snapshot transaction")
+	}
+
+	_, err = tx.ExecContext(ctx, "set transaction snapshot "+pq.QuoteLiteral(s.id))
+	if err != nil {
+		tx.Rollback()
+		return nil, errors.Wrapf(err, "failed to import snapshot %s", s.id)
+	}
+
+	return tx, nil
+}
+
+// Close ends the exporting transaction. Transactions which have already
+// joined the snapshot keep reading from it.
+func (s *pgSnapshot) Close() error {
+	return s.tx.Rollback()
+}
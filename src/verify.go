@@ -0,0 +1,332 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/big"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	rangeBlocks   = "SELECT block_hash FROM blocks WHERE block_height BETWEEN ? AND ?"
+	rangeReceipts = "SELECT receipt_id FROM receipts WHERE included_in_block_hash IN (" + rangeBlocks + ")"
+	rangeTxns     = "SELECT transaction_hash FROM transactions WHERE included_in_block_hash IN (" + rangeBlocks + ")"
+)
+
+// rangeConditions select the rows of each table which belong to the blocks
+// between the two heights passed as query arguments. They are valid in both
+// Postgres and SingleStore.
+var rangeConditions = map[string]string{
+	"access_keys":                "last_update_block_height BETWEEN ? AND ?",
+	"account_changes":            "changed_in_block_hash IN (" + rangeBlocks + ")",
+	"accounts":                   "last_update_block_height BETWEEN ? AND ?",
+	"action_receipt_actions":     "receipt_id IN (" + rangeReceipts + ")",
+	"action_receipt_input_data":  "input_to_receipt_id IN (" + rangeReceipts + ")",
+	"action_receipt_output_data": "output_from_receipt_id IN (" + rangeReceipts + ")",
+	"action_receipts":            "receipt_id IN (" + rangeReceipts + ")",
+	"blocks":                     "block_height BETWEEN ? AND ?",
+	"chunks":                     "included_in_block_hash IN (" + rangeBlocks + ")",
+	"data_receipts":              "receipt_id IN (" + rangeReceipts + ")",
+	"execution_outcome_receipts": "executed_receipt_id IN (" + rangeReceipts + ")",
+	"execution_outcomes":         "executed_in_block_hash IN (" + rangeBlocks + ")",
+	"receipts":                   "included_in_block_hash IN (" + rangeBlocks + ")",
+	"transaction_actions":        "transaction_hash IN (" + rangeTxns + ")",
+	"transactions":               "included_in_block_hash IN (" + rangeBlocks + ")",
+}
+
+// verifyQueries select the key columns of every row in rangeConditions. The
+// same query is run against Postgres and SingleStore.
+//
+// Rows of tables with an updatedQuery are updated in place, and belong to
+// the block of their last update. A row updated in Postgres above the
+// verified heights is still in its earlier range in SingleStore until the
+// update is replicated, so updatedQuery selects the keys of such rows from
+// Postgres, which are not counted as extra.
+var verifyQueries = []struct {
+	table        string
+	query        string
+	updatedQuery string
+}{
+	{"access_keys", "SELECT public_key, account_id FROM access_keys", "SELECT public_key, account_id FROM access_keys WHERE last_update_block_height > ?"},
+	{"account_changes", "SELECT id FROM account_changes", ""},
+	{"accounts", "SELECT id FROM accounts", "SELECT id FROM accounts WHERE last_update_block_height > ?"},
+	{"action_receipt_actions", "SELECT receipt_id, index_in_action_receipt FROM action_receipt_actions", ""},
+	{"action_receipt_input_data", "SELECT input_data_id, input_to_receipt_id FROM action_receipt_input_data", ""},
+	{"action_receipt_output_data", "SELECT output_data_id, output_from_receipt_id FROM action_receipt_output_data", ""},
+	{"action_receipts", "SELECT receipt_id FROM action_receipts", ""},
+	{"blocks", "SELECT block_hash FROM blocks", ""},
+	{"chunks", "SELECT chunk_hash FROM chunks", ""},
+	{"data_receipts", "SELECT data_id FROM data_receipts", ""},
+	{"execution_outcome_receipts", "SELECT executed_receipt_id, index_in_execution_outcome FROM execution_outcome_receipts", ""},
+	{"execution_outcomes", "SELECT receipt_id FROM execution_outcomes", ""},
+	{"receipts", "SELECT receipt_id FROM receipts", ""},
+	{"transaction_actions", "SELECT transaction_hash, index_in_transaction FROM transaction_actions", ""},
+	{"transactions", "SELECT transaction_hash FROM transactions", ""},
+}
+
+func init() {
+	verified := make(map[string]bool)
+	for i, q := range verifyQueries {
+		verified[q.table] = true
+		verifyQueries[i].query += " WHERE " + rangeConditions[q.table]
+	}
+	for _, model := range Models {
+		if rangeConditions[model.Table] == "" || !verified[model.Table] {
+			panic(fmt.Sprintf("table %s has no verify query", model.Table))
+		}
+	}
+}
+
+// postgresPlaceholders numbers the ? placeholders in query for Postgres.
+func postgresPlaceholders(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// TableChecksum is the number of rows returned by a verify query along with
+// an order independent hash of their keys.
+type TableChecksum struct {
+	Rows int64
+	Hash uint64
+}
+
+// keyString joins the key columns of a row into one string.
+func keyString(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+func checksumKeys(ctx context.Context, db querier, query string, args ...interface{}) (TableChecksum, error) {
+	var sum TableChecksum
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return sum, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return sum, err
+	}
+
+	values := make([]string, len(columns))
+	dst := make([]interface{}, len(columns))
+	for i := range values {
+		dst[i] = &values[i]
+	}
+	for rows.Next() {
+		err = rows.Scan(dst...)
+		if err != nil {
+			return sum, err
+		}
+		h := fnv.New64a()
+		h.Write([]byte(keyString(values)))
+		sum.Rows++
+		sum.Hash += h.Sum64()
+	}
+	return sum, rows.Err()
+}
+
+// diffKeys returns the number of keys selected by pgQuery from Postgres
+// which are not selected by sdbQuery from SingleStore, and the number of keys
+// selected from SingleStore which are not selected from Postgres and are not
+// in updated.
+func diffKeys(ctx context.Context, pg querier, sdb querier, pgQuery string, sdbQuery string, updated map[string]bool, args ...interface{}) (missing int64, extra int64, err error) {
+	pgKeys, err := readKeys(ctx, pg, pgQuery, args...)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to read keys from postgres")
+	}
+	sdbKeys, err := readKeys(ctx, sdb, sdbQuery, args...)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to read keys from singlestore")
+	}
+
+	replicated := make(map[string]bool, len(sdbKeys))
+	for _, key := range sdbKeys {
+		replicated[keyString(key)] = true
+	}
+	for _, key := range pgKeys {
+		k := keyString(key)
+		if replicated[k] {
+			delete(replicated, k)
+		} else {
+			missing++
+		}
+	}
+	for k := range replicated {
+		if !updated[k] {
+			extra++
+		}
+	}
+	return missing, extra, nil
+}
+
+// readUpdatedKeys returns the keys selected by query, an updatedQuery, from
+// Postgres for rows updated above height.
+func readUpdatedKeys(ctx context.Context, pg querier, query string, height *big.Int) (map[string]bool, error) {
+	keys, err := readKeys(ctx, pg, postgresPlaceholders(query), height.String())
+	if err != nil {
+		return nil, err
+	}
+	updated := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		updated[keyString(key)] = true
+	}
+	return updated, nil
+}
+
+// Divergence is a table whose rows for a range of blocks differ between
+// Postgres and SingleStore.
+type Divergence struct {
+	Table       string
+	StartHeight *big.Int
+	EndHeight   *big.Int
+	Postgres    TableChecksum
+	SingleStore TableChecksum
+
+	// Missing is the number of rows in Postgres which are not in SingleStore,
+	// and Extra the number of rows in SingleStore which are not in Postgres.
+	Missing int64
+	Extra   int64
+}
+
+func (d Divergence) String() string {
+	return fmt.Sprintf("blocks %s to %s: %s differs; postgres has %d rows (hash %016x), singlestore has %d rows (hash %016x); %d rows are missing from singlestore and %d are extra",
+		d.StartHeight, d.EndHeight, d.Table, d.Postgres.Rows, d.Postgres.Hash, d.SingleStore.Rows, d.SingleStore.Hash, d.Missing, d.Extra)
+}
+
+// Verify compares the rows in Postgres and SingleStore for a range of blocks,
+// split into ranges of RangeSize heights so that divergence can be narrowed
+// down to the blocks it affects.
+type Verify struct {
+	StartHeight *big.Int
+	EndHeight   *big.Int
+	RangeSize   int64
+
+	// Tables is the graph of replicated tables, or nil for every table.
+	// Tables which are not loaded are not compared.
+	Tables *TableGraph
+}
+
+// Run compares every range and table, returning the ones which differ. The
+// verify metrics are updated once every range has been compared.
+func (v *Verify) Run(ctx context.Context, pgConn *sql.DB, sdbConn *sql.DB) ([]Divergence, error) {
+	if v.EndHeight.Cmp(v.StartHeight) < 0 {
+		return nil, errors.Errorf("end height %s is below start height %s", v.EndHeight, v.StartHeight)
+	}
+	if v.RangeSize < 1 {
+		return nil, errors.New("range size must be positive")
+	}
+	tables := v.Tables
+	if tables == nil {
+		tables = DefaultTableGraph
+	}
+
+	for _, q := range verifyQueries {
+		if tables.Loads(q.table) && !tables.LoadsWithParents(q.table) {
+			log.Printf("skipping %s since the tables it is joined through are not replicated", q.table)
+		}
+	}
+
+	divergences := make([]Divergence, 0)
+	for _, r := range splitHeights(v.StartHeight, v.EndHeight, v.RangeSize) {
+		found, err := verifyRange(ctx, pgConn, sdbConn, tables, r.start, r.end, v.EndHeight)
+		if err != nil {
+			return nil, err
+		}
+		divergences = append(divergences, found...)
+	}
+
+	ranges := make(map[string]int)
+	missing := make(map[string]int64)
+	extra := make(map[string]int64)
+	for _, d := range divergences {
+		ranges[d.Table]++
+		missing[d.Table] += d.Missing
+		extra[d.Table] += d.Extra
+	}
+	for _, q := range verifyQueries {
+		if tables.LoadsWithParents(q.table) {
+			MetricVerifyDivergentRanges.WithLabelValues(q.table).Set(float64(ranges[q.table]))
+			MetricVerifyMissingRows.WithLabelValues(q.table).Set(float64(missing[q.table]))
+			MetricVerifyExtraRows.WithLabelValues(q.table).Set(float64(extra[q.table]))
+		}
+	}
+
+	return divergences, nil
+}
+
+// verifyRange compares every table for the blocks between start and end.
+// Postgres is read from a single snapshot, so that rows written by the
+// indexer while the range is compared do not show up in some tables only.
+// Rows updated in place above last, the end of the verified heights, are not
+// expected in SingleStore yet.
+func verifyRange(ctx context.Context, pgConn *sql.DB, sdbConn *sql.DB, tables *TableGraph, start *big.Int, end *big.Int, last *big.Int) ([]Divergence, error) {
+	snapshot, err := beginSnapshot(ctx, pgConn)
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Close()
+
+	var divergences []Divergence
+	for _, q := range verifyQueries {
+		if !tables.LoadsWithParents(q.table) {
+			continue
+		}
+
+		pgQuery := postgresPlaceholders(q.query)
+		pgSum, err := checksumKeys(ctx, snapshot.tx, pgQuery, start.String(), end.String())
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s from postgres", q.table)
+		}
+		sdbSum, err := checksumKeys(ctx, sdbConn, q.query, start.String(), end.String())
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s from singlestore", q.table)
+		}
+		if pgSum == sdbSum {
+			continue
+		}
+
+		var updated map[string]bool
+		if q.updatedQuery != "" {
+			updated, err = readUpdatedKeys(ctx, snapshot.tx, q.updatedQuery, last)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read updated %s from postgres", q.table)
+			}
+		}
+		missing, extra, err := diffKeys(ctx, snapshot.tx, sdbConn, pgQuery, q.query, updated, start.String(), end.String())
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to compare %s", q.table)
+		}
+		if missing == 0 && extra == 0 {
+			// only rows which have been updated since they were replicated
+			continue
+		}
+		d := Divergence{
+			Table:       q.table,
+			StartHeight: start,
+			EndHeight:   end,
+			Postgres:    pgSum,
+			SingleStore: sdbSum,
+			Missing:     missing,
+			Extra:       extra,
+		}
+		log.Print(d)
+		divergences = append(divergences, d)
+	}
+	return divergences, nil
+}
@@ -0,0 +1,167 @@
+package src
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestPostgresPlaceholders(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT 1", "SELECT 1"},
+		{"block_height BETWEEN ? AND ?", "block_height BETWEEN $1 AND $2"},
+		{
+			"receipt_id IN (" + rangeReceipts + ")",
+			"receipt_id IN (SELECT receipt_id FROM receipts WHERE included_in_block_hash IN (SELECT block_hash FROM blocks WHERE block_height BETWEEN $1 AND $2))",
+		},
+		{"? ? ?", "$1 $2 $3"},
+	}
+	for _, tt := range tests {
+		if got := postgresPlaceholders(tt.query); got != tt.want {
+			t.Errorf("postgresPlaceholders(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+// keysDB returns a database which answers every query with the given keys of
+// two columns.
+func keysDB(t *testing.T, keys ...[]string) querier {
+	db, _ := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+		return []string{"a", "b"}, keys, nil
+	})
+	return db
+}
+
+func TestChecksumKeys(t *testing.T) {
+	ctx := context.Background()
+	checksum := func(keys ...[]string) TableChecksum {
+		sum, err := checksumKeys(ctx, keysDB(t, keys...), "SELECT a, b FROM t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+
+	sum := checksum([]string{"x", "1"}, []string{"y", "2"})
+	if sum.Rows != 2 {
+		t.Errorf("rows = %d, want 2", sum.Rows)
+	}
+	if reordered := checksum([]string{"y", "2"}, []string{"x", "1"}); reordered != sum {
+		t.Errorf("checksum depends on the order of rows: %v != %v", reordered, sum)
+	}
+	if other := checksum([]string{"x", "1"}, []string{"y", "3"}); other == sum {
+		t.Errorf("checksum of different keys is the same: %v", other)
+	}
+	// the columns of a key are kept apart
+	if other := checksum([]string{"x1", ""}, []string{"y", "2"}); other == sum {
+		t.Errorf("checksum of keys split differently is the same: %v", other)
+	}
+	if empty := checksum(); empty != (TableChecksum{}) {
+		t.Errorf("checksum of no rows = %v", empty)
+	}
+}
+
+func TestDiffKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		pg      [][]string
+		sdb     [][]string
+		updated map[string]bool
+		missing int64
+		extra   int64
+	}{
+		{"same", [][]string{{"x", "1"}, {"y", "2"}}, [][]string{{"y", "2"}, {"x", "1"}}, nil, 0, 0},
+		{"missing", [][]string{{"x", "1"}, {"y", "2"}}, [][]string{{"x", "1"}}, nil, 1, 0},
+		{"extra", [][]string{{"x", "1"}}, [][]string{{"x", "1"}, {"y", "2"}, {"z", "3"}}, nil, 0, 2},
+		// as many rows on both sides, but not the same ones
+		{"replaced", [][]string{{"x", "1"}, {"y", "2"}}, [][]string{{"x", "1"}, {"y", "3"}}, nil, 1, 1},
+		// rows updated in postgres since they were replicated
+		{"updated", [][]string{{"x", "1"}}, [][]string{{"x", "1"}, {"y", "2"}, {"z", "3"}}, map[string]bool{keyString([]string{"y", "2"}): true}, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			missing, extra, err := diffKeys(context.Background(), keysDB(t, tt.pg...), keysDB(t, tt.sdb...), "SELECT a, b FROM t", "SELECT a, b FROM t", tt.updated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if missing != tt.missing || extra != tt.extra {
+				t.Errorf("missing, extra = %d, %d, want %d, %d", missing, extra, tt.missing, tt.extra)
+			}
+		})
+	}
+}
+
+func TestVerifyRun(t *testing.T) {
+	// blocks by the start of the range they are read for
+	pgBlocks := map[string][][]string{"1": {{"a"}, {"b"}, {"c"}}, "11": {{"k"}}}
+	sdbBlocks := map[string][][]string{"1": {{"b"}, {"c"}, {"d"}, {"e"}}, "11": {{"k"}}}
+	// account 2 was updated in postgres above the verified heights, so it is
+	// still in its earlier range in singlestore; account 3 was lost
+	pgAccounts := map[string][][]string{"1": {{"1"}}}
+	sdbAccounts := map[string][][]string{"1": {{"1"}, {"2"}}, "11": {{"3"}}}
+	pgConn, pg := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+		switch {
+		case query == "select pg_export_snapshot()":
+			return []string{"pg_export_snapshot"}, [][]string{{"00000003-1"}}, nil
+		case strings.HasPrefix(query, "SELECT block_hash FROM blocks"):
+			return []string{"block_hash"}, pgBlocks[args[0].(string)], nil
+		case strings.HasPrefix(query, "SELECT id FROM accounts WHERE last_update_block_height >"):
+			if args[0].(string) != "20" {
+				return nil, nil, fmt.Errorf("read accounts updated above %v", args[0])
+			}
+			return []string{"id"}, [][]string{{"2"}}, nil
+		case strings.HasPrefix(query, "SELECT id FROM accounts"):
+			return []string{"id"}, pgAccounts[args[0].(string)], nil
+		}
+		return nil, nil, nil
+	})
+	sdbConn, _ := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]string, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT block_hash FROM blocks"):
+			return []string{"block_hash"}, sdbBlocks[args[0].(string)], nil
+		case strings.HasPrefix(query, "SELECT id FROM accounts"):
+			return []string{"id"}, sdbAccounts[args[0].(string)], nil
+		}
+		return nil, nil, nil
+	})
+
+	tables, err := DefaultTableGraph.Select([]string{"blocks", "accounts"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &Verify{StartHeight: big.NewInt(1), EndHeight: big.NewInt(20), RangeSize: 10, Tables: tables}
+	divergences, err := v.Run(context.Background(), pgConn, sdbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(divergences) != 2 {
+		t.Fatalf("divergences = %v, want two", divergences)
+	}
+	if d := divergences[1]; d.Table != "accounts" || d.StartHeight.Int64() != 11 || d.Missing != 0 || d.Extra != 1 {
+		t.Errorf("divergence = %+v, want one extra account from 11", d)
+	}
+	d := divergences[0]
+	if d.Table != "blocks" || d.StartHeight.Int64() != 1 || d.EndHeight.Int64() != 10 {
+		t.Errorf("divergence in %s from %s to %s, want blocks from 1 to 10", d.Table, d.StartHeight, d.EndHeight)
+	}
+	if d.Postgres.Rows != 3 || d.SingleStore.Rows != 4 || d.Missing != 1 || d.Extra != 2 {
+		t.Errorf("divergence = %+v, want 3 and 4 rows with 1 missing and 2 extra", d)
+	}
+
+	// every range is read from its own snapshot
+	var pgStatements []string
+	for _, stmt := range pg.Statements() {
+		if stmt == "BEGIN" || stmt == "select pg_export_snapshot()" {
+			pgStatements = append(pgStatements, stmt)
+		}
+	}
+	if len(pgStatements) != 4 {
+		t.Errorf("postgres statements = %v, want two snapshots", pgStatements)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"log"
+	"math/big"
+	"time"
+
+	"f0a.org/singlestore-near-analytics/src"
+	"github.com/pkg/errors"
+)
+
+var verifyFlags = flag.NewFlagSet("verify", flag.ExitOnError)
+
+var verifyStartHeight = verifyFlags.String("start-height", "", "first block height to verify; defaults to the lowest replicated block")
+var verifyEndHeight = verifyFlags.String("end-height", "", "last block height to verify (inclusive); defaults to the highest replicated block")
+var verifyRangeSize = verifyFlags.Int64("range-size", 10000, "number of block heights to compare at a time; divergence is reported per range")
+var verifyInterval = verifyFlags.Duration("interval", 0, "verify again every interval until stopped, updating the verify metrics (0 verifies once)")
+
+func runVerify(stopCtx context.Context, abortCtx context.Context, config *src.Config, pgConn *sql.DB, sdbConn *sql.DB) error {
+	opts, err := config.ExtractOptions()
+	if err != nil {
+		return err
+	}
+	if opts.Accounts != nil {
+		return errors.New("verify can not be used with the accounts filter")
+	}
+
+	for {
+		var startHeight *big.Int
+		if *verifyStartHeight == "" {
+			startHeight, err = src.ReadMinReplicatedBlockHeight(sdbConn)
+			if err != nil {
+				return errors.Wrap(err, "unable to read lowest block from singlestore")
+			}
+		} else {
+			startHeight = src.ParseBigInt(*verifyStartHeight)
+		}
+
+		var endHeight *big.Int
+		if *verifyEndHeight == "" {
+			endHeight, err = src.ReadMaxReplicatedBlockHeight(sdbConn)
+			if err != nil {
+				return errors.Wrap(err, "unable to read highest block from singlestore")
+			}
+		} else {
+			endHeight = src.ParseBigInt(*verifyEndHeight)
+		}
+
+		verify := &src.Verify{
+			StartHeight: startHeight,
+			EndHeight:   endHeight,
+			RangeSize:   *verifyRangeSize,
+			Tables:      opts.Tables,
+		}
+		log.Printf("verifying blocks %s to %s", verify.StartHeight, verify.EndHeight)
+		divergences, err := verify.Run(stopCtx, pgConn, sdbConn)
+		if err != nil {
+			if stopCtx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		if *verifyInterval <= 0 {
+			if len(divergences) > 0 {
+				return errors.Errorf("found %d divergent tables and ranges", len(divergences))
+			}
+			log.Printf("postgres and singlestore match")
+			return nil
+		}
+		log.Printf("found %d divergent tables and ranges; verifying again in %s", len(divergences), *verifyInterval)
+
+		select {
+		case <-stopCtx.Done():
+			return nil
+		case <-time.After(*verifyInterval):
+		}
+	}
+}